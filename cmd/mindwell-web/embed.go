@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/embedder"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/images"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/mediaproxy"
+)
+
+// embedResolveHandler returns the html of a link or an image rendered as pending
+// in the embed, preview or placeholder mode.
+// It responds with 202 while the embed is loading and with 404 if it is unknown.
+func embedResolveHandler(linkEmb *embedder.Embedder, imgEmb *images.ImageEmbedder) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		href := ctx.Query("url")
+		mode := ctx.Query("mode")
+		isImage := ctx.Query("type") == "image"
+
+		if href == "" {
+			ctx.Status(http.StatusBadRequest)
+			return
+		}
+
+		ctx.Header("Cache-Control", "no-store")
+
+		var content string
+		var found, pending bool
+
+		if isImage {
+			var img *images.ImageData
+			img, found = imgEmb.Resolve(href)
+			if found && mode == "preview" {
+				content = img.Preview
+			} else if found {
+				content = img.Embed
+			}
+			pending = !found && imgEmb.IsPending(href)
+		} else {
+			var emb embedder.Embeddable
+			emb, found = linkEmb.Resolve(href)
+			if found {
+				switch mode {
+				case "preview":
+					content = emb.Preview()
+				case "placeholder":
+					content = embedder.Placeholder(emb)
+				default:
+					content = emb.Embed()
+				}
+			}
+			pending = !found && linkEmb.IsPending(href)
+		}
+
+		if pending {
+			ctx.Status(http.StatusAccepted)
+			return
+		}
+
+		if found {
+			ctx.Data(http.StatusOK, "text/html; charset=utf-8", []byte(content))
+			return
+		}
+
+		ctx.Status(http.StatusNotFound)
+	}
+}
+
+// mediaProxyHandler serves third-party images by the urls signed by the embedders.
+func mediaProxyHandler(mp *mediaproxy.Proxy) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		src := ctx.Query("u")
+		sig := ctx.Query("sig")
+
+		if !mp.Verify(src, sig) {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+
+		data, contentType, err := mp.Load(src)
+		if err != nil {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+
+		ctx.Header("Cache-Control", "public, max-age=604800, immutable")
+		ctx.Header("X-Content-Type-Options", "nosniff")
+		ctx.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+		ctx.Data(http.StatusOK, contentType, data)
+	}
+}
+
+// isCacheAdmin checks the access to the cache page the same way as the adm page does, by the API.
+// Otherwise it writes the not found page.
+func isCacheAdmin(mdw *utils.Mindwell, ctx *gin.Context, api *utils.APIRequest) bool {
+	if api.HasUserKey() {
+		if mdw.ConfigBool("adm.reg_finished") {
+			api.MethodForwardTo(http.MethodGet, "/adm/grandfather", false)
+		} else {
+			api.MethodForwardTo(http.MethodGet, "/adm/grandson", false)
+		}
+
+		if api.Error() == nil {
+			api.ClearData()
+			return true
+		}
+
+		// the auth has been refreshed
+		if ctx.Writer.Written() {
+			return false
+		}
+	}
+
+	api.WriteErrorTemplate(http.StatusNotFound, "Мы очень старались, но не смогли найти страницу по такому адресу.")
+
+	return false
+}
+
+// admCacheHandler shows the state of the embed and image caches and the cached entries of the url.
+func admCacheHandler(mdw *utils.Mindwell, linkEmb *embedder.Embedder, imgEmb *images.ImageEmbedder) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		api := utils.NewRequest(mdw, ctx)
+		if !isCacheAdmin(mdw, ctx, api) {
+			return
+		}
+
+		api.SetMe()
+		api.SetData("__adm", true)
+		api.SetCsrfToken("/adm/cache")
+		api.SetData("links", linkEmb.Stats())
+		api.SetData("images", imgEmb.Stats())
+		api.SetDataFromQuery("status", "")
+
+		if href := ctx.Query("url"); href != "" {
+			api.SetData("url", href)
+
+			if info, found := linkEmb.Lookup(href); found || info.Pending {
+				api.SetData("link", info)
+			}
+
+			api.SetData("image_entries", imgEmb.Lookup(href))
+		}
+
+		api.WriteTemplate("settings/cache")
+	}
+}
+
+// admCacheSaverHandler purges or reloads the cached entries of the url.
+func admCacheSaverHandler(mdw *utils.Mindwell, linkEmb *embedder.Embedder, imgEmb *images.ImageEmbedder) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		api := utils.NewRequest(mdw, ctx)
+
+		api.CheckCsrfTokenRead()
+		if api.Error() != nil {
+			api.WriteTemplate("error")
+			return
+		}
+
+		if !isCacheAdmin(mdw, ctx, api) {
+			return
+		}
+
+		href := ctx.PostForm("url")
+
+		// purged entries are loaded again on the next view, so they cannot be reloaded
+		var status string
+		switch ctx.PostForm("action") {
+		case "purge":
+			found := linkEmb.Purge(href)
+			if imgEmb.Purge(href) > 0 || found {
+				status = "purged"
+			} else {
+				status = "missing"
+			}
+		case "reload":
+			found := linkEmb.Reload(href)
+			if imgEmb.Reload(href) > 0 || found {
+				status = "reloading"
+			} else {
+				status = "missing"
+			}
+		default:
+			api.Redirect("/adm/cache")
+			return
+		}
+
+		mdw.LogSystem().Info("adm cache: " + status + " " + href)
+
+		api.Redirect("/adm/cache?status=" + status + "&url=" + url.QueryEscape(href))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,11 +17,23 @@ import (
 	"github.com/patrickmn/go-cache"
 
 	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/embedder"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/images"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/mediaproxy"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/sitemap"
 )
 
 func main() {
 	mdw := utils.NewMindwell()
-	pongo2.InitPongo2(mdw)
+
+	mp := mediaproxy.NewProxy(mdw)
+	linkEmb := embedder.NewEmbedder(mdw, mdw.LogSystem(), mp)
+	imgEmb := images.NewImageEmbedder(mdw, mdw.LogSystem(), mp)
+	pongo2.InitPongo2(linkEmb, imgEmb)
+	go saveCachesPeriodically(mdw, linkEmb, imgEmb)
+
+	sm := sitemap.NewSitemap(mdw)
+	sm.Start()
 
 	gin.SetMode(gin.ReleaseMode)
 
@@ -34,8 +47,13 @@ func main() {
 
 	web.GET("/", rootHandler)
 	web.GET("/robots.txt", robotsHandler(mdw))
-	web.GET("/sitemap.xml", sitemapHandler(mdw))
+	web.GET("/health", healthHandler(mdw))
+	web.GET("/sitemap.xml", sitemapHandler(sm))
+	web.GET("/sitemap-:file", sitemapHandler(sm))
 	web.GET("/index.html", indexHandler(mdw))
+	web.GET("/oembed", oembedHandler(mdw, imgEmb))
+	web.GET("/embed/resolve", embedResolveHandler(linkEmb, imgEmb))
+	web.GET("/proxy/img", mediaProxyHandler(mp))
 
 	web.GET("/oauth", oauthFormHandler(mdw))
 	web.POST("/oauth/allow", oauthAllowHandler(mdw))
@@ -76,6 +94,9 @@ func main() {
 
 	web.GET("/adm", admHandler(mdw))
 
+	web.GET("/adm/cache", admCacheHandler(mdw, linkEmb, imgEmb))
+	web.POST("/adm/cache", admCacheSaverHandler(mdw, linkEmb, imgEmb))
+
 	web.POST("/adm/grandson", grandsonSaverHandler(mdw))
 	web.GET("/adm/grandson/status", proxyHandler(mdw))
 	web.POST("/adm/grandson/status", proxyHandler(mdw))
@@ -93,7 +114,9 @@ func main() {
 	web.POST("/account/recover/password", recoverHandler(mdw))
 
 	web.GET("/live", liveHandler(mdw))
+	web.GET("/live/rss", liveRssHandler(mdw))
 	web.GET("/best", bestHandler(mdw))
+	web.GET("/best/rss", bestRssHandler(mdw))
 	web.GET("/friends", friendsHandler(mdw))
 	web.GET("/watching", watchingHandler(mdw))
 
@@ -102,6 +125,8 @@ func main() {
 	web.GET("/users/:name/tags", proxyNoKeyHandler(mdw))
 	web.GET("/users/:name/calendar", proxyNoKeyHandler(mdw))
 	web.GET("/users/:name/entries", tlogHandler(mdw, "/users", true))
+	web.GET("/users/:name/rss", tlogRssHandler(mdw, "/users"))
+	web.GET("/users/:name/embed", profileEmbedHandler(mdw, "/users"))
 	web.GET("/users/:name/comments", authorCommentsHandler(mdw, "/users"))
 	web.GET("/users/:name/favorites", favoritesHandler(mdw))
 	web.GET("/users/:name/images", imagesHandler(mdw, "/users"))
@@ -112,6 +137,8 @@ func main() {
 	web.GET("/themes/:name/tags", proxyNoKeyHandler(mdw))
 	web.GET("/themes/:name/calendar", proxyNoKeyHandler(mdw))
 	web.GET("/themes/:name/entries", tlogHandler(mdw, "/themes", true))
+	web.GET("/themes/:name/rss", tlogRssHandler(mdw, "/themes"))
+	web.GET("/themes/:name/embed", profileEmbedHandler(mdw, "/themes"))
 	web.GET("/themes/:name/comments", authorCommentsHandler(mdw, "/themes"))
 	web.GET("/themes/:name/images", imagesHandler(mdw, "/themes"))
 	web.GET("/themes/:name/relations/:relation", usersHandler(mdw, "/themes"))
@@ -139,7 +166,8 @@ func main() {
 	web.GET("/entries/:id/edit", editorExistingHandler(mdw))
 	web.POST("/entries/:id", editPostHandler(mdw))
 
-	web.GET("/entries/:id", entryHandler(mdw))
+	web.GET("/entries/:id", entryHandler(mdw, imgEmb))
+	web.GET("/entries/:id/embed", entryEmbedHandler(mdw))
 	web.DELETE("/entries/:id", proxyHandler(mdw))
 
 	web.GET("/entries/:id/comments", commentsHandler(mdw))
@@ -234,9 +262,32 @@ func main() {
 		mdw.LogSystem().Fatal(err.Error())
 	}
 
+	saveCaches(mdw, linkEmb, imgEmb)
+
 	mdw.LogSystem().Info("Exit server")
 }
 
+func saveCaches(mdw *utils.Mindwell, linkEmb *embedder.Embedder, imgEmb *images.ImageEmbedder) {
+	if err := linkEmb.Save(); err != nil {
+		mdw.LogSystem().Error(err.Error())
+	}
+
+	if err := imgEmb.Save(); err != nil {
+		mdw.LogSystem().Error(err.Error())
+	}
+}
+
+func saveCachesPeriodically(mdw *utils.Mindwell, linkEmb *embedder.Embedder, imgEmb *images.ImageEmbedder) {
+	interval := mdw.ConfigInt("cache.save_interval")
+	if interval <= 0 {
+		interval = 60
+	}
+
+	for range time.Tick(time.Duration(interval) * time.Minute) {
+		saveCaches(mdw, linkEmb, imgEmb)
+	}
+}
+
 func hostHandler(host string) func(ctx *gin.Context) {
 	host = strings.ToLower(host)
 
@@ -269,12 +320,26 @@ func robotsHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	}
 }
 
-func sitemapHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
+func sitemapHandler(sm *sitemap.Sitemap) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
-		api := utils.NewRequest(mdw, ctx)
+		if !sm.IsReady() {
+			ctx.Header("Retry-After", "600")
+			ctx.Status(http.StatusServiceUnavailable)
+			return
+		}
+
+		name := "sitemap.xml"
+		if file := ctx.Param("file"); file != "" {
+			name = "sitemap-" + file
+		}
+
+		data, ok := sm.File(name)
+		if !ok {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
 
-		ctx.Header("Content-Type", "application/xml")
-		api.WriteTemplateWithExtension("seo/sitemap.xml")
+		ctx.Data(http.StatusOK, "application/xml; charset=utf-8", data)
 	}
 }
 
@@ -331,7 +396,7 @@ func oauthFormHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	}
 }
 
-func handleOAuth(ctx *gin.Context, api *utils.APIRequest) {
+func handleOAuth(ctx *gin.Context, api *utils.APIRequest, path string) {
 	appID := ctx.Query("client_id")
 	redirect, ok := authCache.Get(appID)
 	if !ok {
@@ -340,19 +405,22 @@ func handleOAuth(ctx *gin.Context, api *utils.APIRequest) {
 	}
 	uri := redirect.(string)
 
-	if api.StatusCode() == 200 {
-		code := api.Data()["code"].(string)
-		state := api.Data()["state"].(string)
-		api.RedirectToHost(uri + "?code=" + code + "&state=" + state)
-	} else if api.StatusCode() == 400 {
+	code, oauthErr, err := api.Client().OAuth2(path)
+	switch {
+	case code != nil && err == nil:
+		query := url.Values{}
+		query.Set("code", code.Code)
+		query.Set("state", code.State)
+		api.RedirectToHost(uri + "?" + query.Encode())
+	case oauthErr != nil:
 		api.SkipError()
-		errType := api.Data()["error"].(string)
-		if errType == "invalid_redirect" || errType == "unrecognized_client" {
+		errType := oauthErr.Error
+		if errType == "" || errType == "invalid_redirect" || errType == "unrecognized_client" {
 			api.WriteTemplate("error")
 		} else {
-			ctx.Redirect(http.StatusSeeOther, uri+"?error="+errType)
+			ctx.Redirect(http.StatusSeeOther, uri+"?error="+url.QueryEscape(errType))
 		}
-	} else {
+	default:
 		api.WriteTemplate("error")
 	}
 }
@@ -367,18 +435,14 @@ func oauthAllowHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 			return
 		}
 
-		api.ForwardTo("/oauth2/allow")
-
-		handleOAuth(ctx, api)
+		handleOAuth(ctx, api, "/oauth2/allow")
 	}
 }
 
 func oauthDenyHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.ForwardTo("/oauth2/deny")
-
-		handleOAuth(ctx, api)
+		handleOAuth(ctx, api, "/oauth2/deny")
 	}
 }
 
@@ -830,6 +894,74 @@ func bestHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	}
 }
 
+func writeFeed(ctx *gin.Context, api *utils.APIRequest, title, description, link string) {
+	if api.Error() != nil {
+		api.WriteTemplate("error")
+		return
+	}
+
+	api.SetScrollHrefs()
+	api.SetData("__feed_title", title)
+	api.SetData("__feed_description", description)
+	api.SetData("__feed_link", link)
+	api.SetData("__feed_self", ctx.Request.URL.RequestURI())
+	api.SetData("__now", time.Now())
+
+	if ctx.Query("format") == "atom" {
+		ctx.Header("Content-Type", "application/atom+xml; charset=utf-8")
+		api.WriteTemplateWithExtension("seo/atom.xml")
+	} else {
+		ctx.Header("Content-Type", "application/rss+xml; charset=utf-8")
+		api.WriteTemplateWithExtension("seo/rss.xml")
+	}
+}
+
+func liveRssHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		api := utils.NewAppRequest(mdw, ctx, ctx.Request.URL.Query())
+		api.ForwardToNoKey("/entries/live")
+		writeFeed(ctx, api, "Прямой эфир", "Новые записи в прямом эфире Майндвелла.", "/live")
+	}
+}
+
+func bestRssHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		api := utils.NewAppRequest(mdw, ctx, ctx.Request.URL.Query())
+		api.ForwardToNoKey("/entries/best")
+		writeFeed(ctx, api, "Лучшее", "Лучшие записи Майндвелла.", "/best")
+	}
+}
+
+func tlogRssHandler(mdw *utils.Mindwell, baseApiPath string) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		api := utils.NewAppRequest(mdw, ctx, ctx.Request.URL.Query())
+
+		api.SetFieldNoKey("profile", baseApiPath+"/"+name)
+		if api.Error() != nil {
+			api.WriteTemplate("error")
+			return
+		}
+
+		profile, _ := api.Data()["profile"].(map[string]interface{})
+		api.ClearData()
+
+		showName, _ := profile["showName"].(string)
+		description, _ := profile["title"].(string)
+		if description == "" {
+			if isTheme, _ := profile["isTheme"].(bool); isTheme {
+				description = "Тема " + showName + "."
+			} else {
+				description = "Личный дневник " + showName + "."
+			}
+		}
+
+		api.ForwardToNoKey(baseApiPath + "/" + name + "/tlog")
+		api.SetData("profile", profile)
+		writeFeed(ctx, api, showName, description, baseApiPath+"/"+name)
+	}
+}
+
 func friendsHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
@@ -911,13 +1043,11 @@ func tlogHandler(mdw *utils.Mindwell, baseApiPath string, isTlog bool) func(ctx
 		}
 
 		if !api.IsAjax() && (!isTlog || api.IsLargeScreen()) {
-			limit := api.SetQuery("limit", "100")
-			api.SetFieldNoKey("tags", baseApiPath+"/"+name+"/tags")
-			api.SetQuery("limit", "9")
-			api.SetFieldNoKey("images", baseApiPath+"/"+name+"/images")
-			api.SetQuery("limit", limit)
-
-			api.SetFieldNoKey("calendar", baseApiPath+"/"+name+"/calendar")
+			api.Fetch(map[string]utils.FetchField{
+				"tags":     {Path: baseApiPath + "/" + name + "/tags?limit=100", AllowNoKey: true, Optional: true},
+				"images":   {Path: baseApiPath + "/" + name + "/images?limit=9", AllowNoKey: true, Optional: true},
+				"calendar": {Path: baseApiPath + "/" + name + "/calendar", AllowNoKey: true, Optional: true},
+			})
 		}
 
 		api.SkipError()
@@ -925,6 +1055,10 @@ func tlogHandler(mdw *utils.Mindwell, baseApiPath string, isTlog bool) func(ctx
 		api.SetData("profile", profile)
 		api.SetData("__feed", isTlog)
 
+		if profileData, ok := profile.(map[string]interface{}); ok {
+			api.SetData("__meta", newProfileMeta(api, profileData))
+		}
+
 		if !api.IsAjax() && !api.HasUserKey() {
 			api.SetCsrfToken("/login")
 			api.SetCsrfToken("/register")
@@ -1058,15 +1192,18 @@ func usersHandler(mdw *utils.Mindwell, baseApiPath string) func(ctx *gin.Context
 func meHandler(mdw *utils.Mindwell, subpath string) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.ForwardTo("/me")
 
-		if api.Error() != nil {
+		me, err := api.Client().Me()
+		if ctx.Writer.Written() {
+			return
+		}
+
+		if err != nil || me.Name == "" {
 			api.WriteTemplate("error")
 			return
 		}
 
-		name := api.Data()["name"].(string)
-		api.Redirect("/users/" + name + subpath)
+		api.Redirect("/users/" + me.Name + subpath)
 	}
 }
 
@@ -1097,21 +1234,16 @@ func coverSaverHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 func themeCreatorHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.Forward()
 
-		if api.Error() != nil {
+		theme, err := api.Client().CreateTheme()
+		if err != nil || theme.Name == "" {
 			api.WriteResponse()
 			return
 		}
 
-		name, ok := api.Data()["name"].(string)
-		if ok {
-			api.ClearData()
-			api.SetData("path", "/themes/"+name)
-			api.WriteJson()
-		} else {
-			api.WriteResponse()
-		}
+		api.ClearData()
+		api.SetData("path", "/themes/"+theme.Name)
+		api.WriteJson()
 	}
 }
 
@@ -1176,22 +1308,15 @@ func postHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
 
-		theme := ctx.Query("theme")
-		if len(theme) > 0 {
-			api.ForwardTo("/themes/" + theme + "/tlog")
-		} else {
-			api.ForwardTo("/me/tlog")
-		}
-
-		entry := api.Data()
-		entryID, ok := entry["id"].(json.Number)
-		if ok {
+		entry, err := api.Client().CreateEntry(ctx.Query("theme"))
+		if err == nil && entry.ID > 0 {
 			api.ClearData()
-			api.SetData("path", "/entries/"+entryID.String())
+			api.SetData("path", "/entries/"+strconv.FormatInt(entry.ID, 10))
 			api.WriteJson()
-		} else if api.StatusCode() == 201 {
+		} else if err == nil && api.StatusCode() == 201 {
+			data := api.Data()
 			api.ClearData()
-			api.SetData("entry", entry)
+			api.SetData("entry", data)
 
 			if api.IsAjax() {
 				api.WriteTemplate("entries/entry_modal")
@@ -1230,35 +1355,40 @@ func editPostHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	}
 }
 
-func entryHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
+func entryHandler(mdw *utils.Mindwell, imgEmb *images.ImageEmbedder) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.ForwardNoKey()
+
+		typed, err := api.Client().Entry()
 
 		entry := api.Data()
 		api.ClearData()
 		api.SetData("entry", entry)
 
-		if entry != nil {
-			entryID := entry["id"].(json.Number).String()
+		if err == nil && entry != nil && typed.ID > 0 {
+			if !api.IsAjax() {
+				api.SetData("__meta", newEntryMeta(api, imgEmb, entry))
+			}
+
+			entryID := strconv.FormatInt(typed.ID, 10)
 			cmts, ok := entry["comments"].(map[string]interface{})
 			if ok {
 				api.SetScrollHrefsWithData("/entries/"+entryID+"/comments", cmts)
 			}
 
-			api.SetFieldNoKey("adjacent", "/entries/"+entryID+"/adjacent")
-			api.SkipError()
+			fields := map[string]utils.FetchField{
+				"adjacent": {Path: "/entries/" + entryID + "/adjacent", AllowNoKey: true, Optional: true},
+				"me":       {Path: "/me"},
+			}
 
-			rights, ok := entry["rights"].(map[string]interface{})
-			if ok {
-				canComment, ok := rights["comment"].(bool)
-				if canComment && ok {
-					api.SetField("commentator", "/entries/"+entryID+"/commentator")
-				}
+			if typed.Rights != nil && typed.Rights.Comment {
+				fields["commentator"] = utils.FetchField{Path: "/entries/" + entryID + "/commentator"}
 			}
-		}
 
-		api.SetMe()
+			api.Fetch(fields)
+		} else {
+			api.SetMe()
+		}
 
 		if !api.HasUserKey() {
 			api.SetCsrfToken("/login")
@@ -1286,7 +1416,9 @@ func commentsHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 func postCommentHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.Forward()
+
+		// the template shows the response as is, even if it does not match the model
+		api.Client().Comment(http.MethodPost)
 
 		cmt := api.Data()
 		api.ClearData()
@@ -1299,7 +1431,8 @@ func postCommentHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 func editCommentHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.MethodForward("PUT")
+
+		api.Client().Comment(http.MethodPut)
 
 		cmt := api.Data()
 		api.ClearData()
@@ -1320,7 +1453,8 @@ func notificationsHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 func singleNotificationHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.Forward()
+
+		api.Client().Notification()
 
 		ntf := api.Data()
 		api.ClearData()
@@ -1390,7 +1524,8 @@ func messagesHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 func singleMessageHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.Forward()
+
+		api.Client().Message(http.MethodGet)
 
 		msg := api.Data()
 		api.ClearData()
@@ -1403,7 +1538,8 @@ func singleMessageHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 func sendMessageHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.Forward()
+
+		api.Client().Message(http.MethodPost)
 
 		msg := api.Data()
 		api.ClearData()
@@ -1416,7 +1552,8 @@ func sendMessageHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 func editMessageHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
-		api.MethodForward("PUT")
+
+		api.Client().Message(http.MethodPut)
 
 		msg := api.Data()
 		api.ClearData()
@@ -1442,6 +1579,25 @@ func proxyNoKeyHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	}
 }
 
+func healthHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		state := mdw.Breaker().State()
+
+		status := "ok"
+		code := http.StatusOK
+		if state == utils.BreakerOpen {
+			status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+
+		ctx.Header("Cache-Control", "no-store")
+		ctx.JSON(code, gin.H{
+			"status": status,
+			"api":    state,
+		})
+	}
+}
+
 func aboutHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		api := utils.NewRequest(mdw, ctx)
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sevings/mindwell-server/utils"
+
+	webUtils "github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/images"
+)
+
+var imgSrcRe = regexp.MustCompile(`(?i)<img[^>]+src="([^"]+)"`)
+
+// pageMeta is exposed to templates as __meta and rendered by base.html
+// as Open Graph, Twitter Card and JSON-LD tags.
+type pageMeta struct {
+	Type        string
+	Url         string
+	Title       string
+	Description string
+	Image       string
+	ImageWidth  int64
+	ImageHeight int64
+	Author      string
+	AuthorUrl   string
+	Username    string
+	Gender      string
+	Published   string
+	JsonLd      string
+}
+
+func webBaseUrl(api *webUtils.APIRequest) string {
+	return api.Server().ConfigString("web.proto") + "://" + api.Server().ConfigString("web.domain")
+}
+
+func plainText(text string, size int) string {
+	text = utils.RemoveHTML(text)
+	text = html.UnescapeString(text)
+	text = strings.Join(strings.Fields(text), " ")
+	text, _ = utils.CutText(text, size)
+	return text
+}
+
+func unixTime(value interface{}) time.Time {
+	var sec float64
+	switch v := value.(type) {
+	case json.Number:
+		sec, _ = v.Float64()
+	case float64:
+		sec = v
+	}
+
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(frac*1e9))
+}
+
+func jsonLd(data map[string]interface{}) string {
+	data["@context"] = "https://schema.org"
+
+	ld, err := json.Marshal(data)
+	if err != nil {
+		return ""
+	}
+
+	return string(ld)
+}
+
+func newEntryMeta(api *webUtils.APIRequest, imgEmb *images.ImageEmbedder, entry map[string]interface{}) *pageMeta {
+	id, _ := entry["id"].(json.Number)
+	meta := &pageMeta{
+		Type:  "article",
+		Url:   webBaseUrl(api) + "/entries/" + id.String(),
+		Title: "Запись",
+	}
+
+	// locked entries leak nothing but the link
+	if privacy, _ := entry["privacy"].(string); privacy != "all" {
+		return meta
+	}
+
+	if title, ok := entry["cutTitle"].(string); ok && title != "" {
+		meta.Title = plainText(title, 100)
+	} else if title, ok := entry["title"].(string); ok && title != "" {
+		meta.Title = plainText(title, 100)
+	}
+
+	content, _ := entry["content"].(string)
+	meta.Description = plainText(content, 200)
+
+	var src string
+	if imgs, ok := entry["images"].([]interface{}); ok && len(imgs) > 0 {
+		img, _ := imgs[0].(map[string]interface{})
+		large, _ := img["large"].(map[string]interface{})
+		src, _ = large["url"].(string)
+	}
+	if src == "" {
+		if match := imgSrcRe.FindStringSubmatch(content); len(match) > 1 {
+			src = match[1]
+		}
+	}
+	if src != "" {
+		img := imgEmb.Convert(`<img src="` + src + `">`)
+		meta.Image = img.Url
+		meta.ImageWidth = img.Width
+		meta.ImageHeight = img.Height
+
+		// the image is still loading
+		if meta.Image == "" {
+			meta.Image = src
+		}
+	}
+
+	published := unixTime(entry["createdAt"])
+	meta.Published = published.UTC().Format(time.RFC3339)
+
+	ld := map[string]interface{}{
+		"@type":            "BlogPosting",
+		"headline":         meta.Title,
+		"description":      meta.Description,
+		"url":              meta.Url,
+		"mainEntityOfPage": meta.Url,
+		"datePublished":    meta.Published,
+	}
+
+	if meta.Image != "" {
+		ld["image"] = meta.Image
+	}
+
+	isAnonymous, _ := entry["isAnonymous"].(bool)
+	author, ok := entry["author"].(map[string]interface{})
+	if ok && !isAnonymous {
+		name, _ := author["name"].(string)
+		meta.Author, _ = author["showName"].(string)
+		meta.AuthorUrl = webBaseUrl(api) + "/users/" + name
+
+		ld["author"] = map[string]interface{}{
+			"@type": "Person",
+			"name":  meta.Author,
+			"url":   meta.AuthorUrl,
+		}
+	}
+
+	meta.JsonLd = jsonLd(ld)
+
+	return meta
+}
+
+func newProfileMeta(api *webUtils.APIRequest, profile map[string]interface{}) *pageMeta {
+	name, _ := profile["name"].(string)
+	showName, _ := profile["showName"].(string)
+	isTheme, _ := profile["isTheme"].(bool)
+
+	meta := &pageMeta{
+		Type:     "profile",
+		Title:    showName,
+		Username: name,
+	}
+
+	if isTheme {
+		meta.Url = webBaseUrl(api) + "/themes/" + name
+		meta.Description = "Тема " + showName + "."
+	} else {
+		meta.Url = webBaseUrl(api) + "/users/" + name
+		meta.Description = "Личный дневник " + showName + "."
+	}
+
+	if gender, _ := profile["gender"].(string); gender == "male" || gender == "female" {
+		meta.Gender = gender
+	}
+
+	if avatar, ok := profile["avatar"].(map[string]interface{}); ok {
+		meta.Image, _ = avatar["x124"].(string)
+	}
+
+	privacy, _ := profile["privacy"].(string)
+	if privacy == "all" {
+		if title, ok := profile["title"].(string); ok && title != "" {
+			meta.Description = plainText(title, 200)
+		}
+	}
+
+	ld := map[string]interface{}{
+		"@type":       "Person",
+		"name":        showName,
+		"url":         meta.Url,
+		"description": meta.Description,
+	}
+
+	if isTheme {
+		ld["@type"] = "Organization"
+	} else {
+		ld["alternateName"] = name
+	}
+
+	if meta.Image != "" {
+		ld["image"] = meta.Image
+	}
+
+	meta.JsonLd = jsonLd(ld)
+
+	return meta
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/images"
+)
+
+var oembedEntryRe = regexp.MustCompile(`^/entries/(\d+)/?$`)
+var oembedTlogRe = regexp.MustCompile(`^/(users|themes)/([0-9a-zA-Z\-_]+)/?$`)
+
+// oembedResponse is described at https://oembed.com/#section2.3
+type oembedResponse struct {
+	XMLName         xml.Name `json:"-" xml:"oembed"`
+	Version         string   `json:"version" xml:"version"`
+	Type            string   `json:"type" xml:"type"`
+	ProviderName    string   `json:"provider_name" xml:"provider_name"`
+	ProviderUrl     string   `json:"provider_url" xml:"provider_url"`
+	Title           string   `json:"title,omitempty" xml:"title,omitempty"`
+	AuthorName      string   `json:"author_name,omitempty" xml:"author_name,omitempty"`
+	AuthorUrl       string   `json:"author_url,omitempty" xml:"author_url,omitempty"`
+	CacheAge        int64    `json:"cache_age,omitempty" xml:"cache_age,omitempty"`
+	ThumbnailUrl    string   `json:"thumbnail_url,omitempty" xml:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int64    `json:"thumbnail_width,omitempty" xml:"thumbnail_width,omitempty"`
+	ThumbnailHeight int64    `json:"thumbnail_height,omitempty" xml:"thumbnail_height,omitempty"`
+	Html            string   `json:"html,omitempty" xml:"html,omitempty"`
+	Width           int      `json:"width,omitempty" xml:"width,omitempty"`
+	Height          int      `json:"height,omitempty" xml:"height,omitempty"`
+	Url             string   `json:"url,omitempty" xml:"url,omitempty"`
+}
+
+func oembedSize(ctx *gin.Context, key string, def int) int {
+	size := def
+
+	if value, err := strconv.Atoi(ctx.Query(key)); err == nil && value > 0 && value < size {
+		size = value
+	}
+
+	return size
+}
+
+func oembedErrorStatus(api *utils.APIRequest) int {
+	code := api.StatusCode()
+
+	// hidden content is not found, so the response does not show that it exists
+	switch {
+	case code >= 400 && code < 500:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func oembedHandler(mdw *utils.Mindwell, imgEmb *images.ImageEmbedder) func(ctx *gin.Context) {
+	webDomain := mdw.ConfigString("web.domain")
+	baseUrl := mdw.ConfigString("web.proto") + "://" + webDomain
+
+	return func(ctx *gin.Context) {
+		format := ctx.DefaultQuery("format", "json")
+		if format != "json" && format != "xml" {
+			ctx.Status(http.StatusNotImplemented)
+			return
+		}
+
+		link, err := url.Parse(ctx.Query("url"))
+		if err != nil || !strings.EqualFold(link.Hostname(), webDomain) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+
+		width := oembedSize(ctx, "maxwidth", 600)
+		height := oembedSize(ctx, "maxheight", 400)
+
+		api := utils.NewAppRequest(mdw, ctx, nil)
+
+		resp := &oembedResponse{
+			Version:      "1.0",
+			ProviderName: "Майндвелл",
+			ProviderUrl:  baseUrl,
+			CacheAge:     3600,
+		}
+
+		if match := oembedEntryRe.FindStringSubmatch(link.Path); match != nil {
+			api.ForwardToNoKey("/entries/" + match[1])
+			if api.Error() != nil {
+				ctx.Status(oembedErrorStatus(api))
+				return
+			}
+
+			entry := api.Data()
+			if privacy, _ := entry["privacy"].(string); privacy != "all" {
+				ctx.Status(http.StatusNotFound)
+				return
+			}
+
+			meta := newEntryMeta(api, imgEmb, entry)
+
+			resp.Type = "rich"
+			resp.Title = meta.Title
+			resp.AuthorName = meta.Author
+			resp.AuthorUrl = meta.AuthorUrl
+			resp.ThumbnailUrl = meta.Image
+			if meta.Image != "" {
+				resp.ThumbnailWidth = meta.ImageWidth
+				resp.ThumbnailHeight = meta.ImageHeight
+			}
+			resp.Width = width
+			resp.Height = height
+
+			const iframe = `<iframe src="%s/entries/%s/embed" width="%d" height="%d" frameborder="0" loading="lazy" sandbox="allow-popups allow-popups-to-escape-sandbox allow-scripts"></iframe>`
+			resp.Html = fmt.Sprintf(iframe, baseUrl, match[1], width, height)
+		} else if match := oembedTlogRe.FindStringSubmatch(link.Path); match != nil {
+			api.ForwardToNoKey("/" + match[1] + "/" + match[2])
+			if api.Error() != nil {
+				ctx.Status(oembedErrorStatus(api))
+				return
+			}
+
+			profile := api.Data()
+			if privacy, _ := profile["privacy"].(string); privacy != "all" {
+				ctx.Status(http.StatusNotFound)
+				return
+			}
+
+			meta := newProfileMeta(api, profile)
+
+			resp.Type = "rich"
+			resp.Title = meta.Title
+			resp.AuthorName = meta.Title
+			resp.AuthorUrl = meta.Url
+			resp.ThumbnailUrl = meta.Image
+			if meta.Image != "" {
+				resp.ThumbnailWidth = 124
+				resp.ThumbnailHeight = 124
+			}
+
+			if height > 200 {
+				height = 200
+			}
+			resp.Width = width
+			resp.Height = height
+
+			const iframe = `<iframe src="%s/%s/%s/embed" width="%d" height="%d" frameborder="0" loading="lazy" sandbox="allow-popups allow-popups-to-escape-sandbox allow-scripts"></iframe>`
+			resp.Html = fmt.Sprintf(iframe, baseUrl, match[1], match[2], width, height)
+		} else {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+
+		ctx.Header("Cache-Control", "public, max-age=3600")
+
+		if format == "xml" {
+			data, err := xml.Marshal(resp)
+			if err != nil {
+				mdw.LogWeb().Error(err.Error())
+				ctx.Status(http.StatusInternalServerError)
+				return
+			}
+
+			ctx.Data(http.StatusOK, "text/xml; charset=utf-8", append([]byte(xml.Header), data...))
+		} else {
+			data, err := json.Marshal(resp)
+			if err != nil {
+				mdw.LogWeb().Error(err.Error())
+				ctx.Status(http.StatusInternalServerError)
+				return
+			}
+
+			ctx.Data(http.StatusOK, "application/json; charset=utf-8", data)
+		}
+	}
+}
+
+func entryEmbedHandler(mdw *utils.Mindwell) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		api := utils.NewAppRequest(mdw, ctx, nil)
+		api.ForwardToNoKey("/entries/" + ctx.Param("id"))
+
+		entry := api.Data()
+		if privacy, _ := entry["privacy"].(string); api.Error() == nil && privacy != "all" {
+			api.WriteErrorTemplate(http.StatusNotFound, "Запись недоступна для встраивания.")
+			return
+		}
+
+		api.ClearData()
+		api.SetData("entry", entry)
+		api.WriteTemplate("entries/entry_embed")
+	}
+}
+
+func profileEmbedHandler(mdw *utils.Mindwell, baseApiPath string) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		api := utils.NewAppRequest(mdw, ctx, nil)
+		api.ForwardToNoKey(baseApiPath + "/" + ctx.Param("name"))
+
+		profile := api.Data()
+		if privacy, _ := profile["privacy"].(string); api.Error() == nil && privacy != "all" {
+			api.WriteErrorTemplate(http.StatusNotFound, "Профиль недоступен для встраивания.")
+			return
+		}
+
+		api.ClearData()
+		api.SetData("profile", profile)
+		api.WriteTemplate("users/profile_embed")
+	}
+}
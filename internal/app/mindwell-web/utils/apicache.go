@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"github.com/patrickmn/go-cache"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/workpool"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	cacheHit   = "hit"
+	cacheStale = "stale"
+	cacheMiss  = "miss"
+)
+
+// apiCachePaths are the API paths of the pages often visited by anonymous users.
+var apiCachePaths = regexp.MustCompile(`^/entries/(?:live|best|\d+)$|^/(?:users|themes)/[^/]+(?:/tlog)?$`)
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	loaded time.Time
+}
+
+func (cr *cachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(cr.status),
+		StatusCode:    cr.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cr.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(cr.body)),
+		ContentLength: int64(len(cr.body)),
+		Request:       req,
+	}
+}
+
+// apiCache keeps the API responses to anonymous GET requests, since they are the same for all users.
+// Stale responses are returned while they are reloaded in background.
+type apiCache struct {
+	mdw      *Mindwell
+	cache    *cache.Cache
+	pool     *workpool.Pool
+	ttl      time.Duration
+	stale    time.Duration
+	maxItems int
+	maxSize  int
+	timeout  time.Duration
+}
+
+func newApiCache(m *Mindwell) *apiCache {
+	ttl := m.configDuration("cache.api_ttl", 0, time.Second)
+	if ttl <= 0 {
+		return nil
+	}
+
+	maxItems := m.ConfigInt("cache.api_items")
+	if maxItems <= 0 {
+		maxItems = 1000
+	}
+
+	maxSize := m.ConfigInt("cache.api_max_size")
+	if maxSize <= 0 {
+		maxSize = 512
+	}
+
+	stale := m.configDuration("cache.api_stale", 0, time.Second)
+
+	return &apiCache{
+		mdw:      m,
+		cache:    cache.New(ttl+stale, time.Minute),
+		pool:     workpool.New(2, 100, m.LogWeb()),
+		ttl:      ttl,
+		stale:    stale,
+		maxItems: maxItems,
+		maxSize:  maxSize * 1024,
+		timeout:  m.configDuration("api.response_timeout", 30*time.Second, time.Second),
+	}
+}
+
+func (ac *apiCache) cacheable(req *http.Request) bool {
+	return ac != nil &&
+		req.Method == http.MethodGet &&
+		req.URL.Host == ac.mdw.host &&
+		apiCachePaths.MatchString(strings.TrimPrefix(req.URL.Path, ac.mdw.path))
+}
+
+// cacheKey is the path with the sorted query, so the order of parameters does not matter.
+// The headers are not the part of the key. The X-Uid, X-Uid2, X-Dev and X-App headers are used
+// by the API only to log the users on GET /me, which is not cached, and the anonymous responses
+// do not depend on the other ones.
+func (ac *apiCache) cacheKey(req *http.Request) string {
+	query := req.URL.Query().Encode()
+	if query == "" {
+		return req.URL.Path
+	}
+
+	return req.URL.Path + "?" + query
+}
+
+// RoundTrip returns the cached response if there is one. It also returns whether the response is
+// fresh, stale or loaded from the API.
+func (ac *apiCache) RoundTrip(req *http.Request) (*http.Response, string, error) {
+	key := ac.cacheKey(req)
+
+	if value, found := ac.cache.Get(key); found {
+		cr := value.(*cachedResponse)
+		if time.Since(cr.loaded) < ac.ttl {
+			return cr.response(req), cacheHit, nil
+		}
+
+		ac.revalidate(key, req)
+		return cr.response(req), cacheStale, nil
+	}
+
+	resp, err := ac.load(key, req)
+	return resp, cacheMiss, err
+}
+
+func (ac *apiCache) revalidate(key string, req *http.Request) {
+	// the web request is finished before the reload, so it must not cancel it
+	bgReq := req.Clone(context.Background())
+
+	ac.pool.Submit(key, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ac.timeout)
+		defer cancel()
+
+		resp, err := ac.load(key, bgReq.WithContext(ctx))
+		if err != nil {
+			return
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	})
+}
+
+func (ac *apiCache) load(key string, req *http.Request) (*http.Response, error) {
+	resp, err := ac.mdw.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	if resp.ContentLength > int64(ac.maxSize) {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(ac.maxSize)+1))
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+
+	if len(body) > ac.maxSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+
+	_ = resp.Body.Close()
+
+	cr := &cachedResponse{
+		status: resp.StatusCode,
+		header: resp.Header.Clone(),
+		body:   body,
+		loaded: time.Now(),
+	}
+
+	_, found := ac.cache.Get(key)
+	if found || ac.cache.ItemCount() < ac.maxItems {
+		ac.cache.SetDefault(key, cr)
+	} else {
+		ac.mdw.LogWeb().Debug("api cache is full",
+			zap.String("key", key),
+		)
+	}
+
+	return cr.response(req), nil
+}
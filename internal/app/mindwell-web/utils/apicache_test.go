@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestApiCacheable(t *testing.T) {
+	ac := &apiCache{mdw: &Mindwell{host: "api.mindwell.test", path: "/api/v1"}}
+
+	tests := []struct {
+		method string
+		url    string
+		ok     bool
+	}{
+		{http.MethodGet, "https://api.mindwell.test/api/v1/entries/live?limit=10", true},
+		{http.MethodGet, "https://api.mindwell.test/api/v1/entries/best", true},
+		{http.MethodGet, "https://api.mindwell.test/api/v1/entries/123", true},
+		{http.MethodGet, "https://api.mindwell.test/api/v1/users/alice", true},
+		{http.MethodGet, "https://api.mindwell.test/api/v1/users/alice/tlog", true},
+		{http.MethodGet, "https://api.mindwell.test/api/v1/themes/books", true},
+		{http.MethodGet, "https://api.mindwell.test/api/v1/themes/books/tlog?before=1", true},
+		{http.MethodPost, "https://api.mindwell.test/api/v1/entries/123", false},
+		{http.MethodGet, "https://api.mindwell.test/api/v1/entries/123/comments", false},
+		{http.MethodGet, "https://api.mindwell.test/api/v1/themes/books/followers", false},
+		{http.MethodGet, "https://api.mindwell.test/api/v1/me", false},
+		{http.MethodGet, "https://img.mindwell.test/api/v1/entries/live", false},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := ac.cacheable(req); got != tt.ok {
+			t.Errorf("%s %s: cacheable %v, want %v", tt.method, tt.url, got, tt.ok)
+		}
+	}
+
+	var disabled *apiCache
+	req, _ := http.NewRequest(http.MethodGet, "https://api.mindwell.test/api/v1/entries/live", nil)
+	if disabled.cacheable(req) {
+		t.Error("disabled cache is used")
+	}
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sevings/mindwell-server/models"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+)
+
+var errorEmptyResponse = errors.New("api: empty response")
+
+// OAuth2Code is the response of the API to the allowed authorization.
+type OAuth2Code struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+// APIClient forwards the web request to the API like APIRequest
+// and decodes the responses into the server models.
+// The responses are still available to templates as Data.
+type APIClient struct {
+	api *APIRequest
+}
+
+func (api *APIRequest) Client() *APIClient {
+	return &APIClient{api: api}
+}
+
+// responseBody reads the response without changing the request error,
+// so the body of the failed responses can be decoded too.
+func (api *APIRequest) responseBody() []byte {
+	if api.resp == nil || api.read {
+		return api.body
+	}
+
+	api.read = true
+
+	body, err := ioutil.ReadAll(api.resp.Body)
+	_ = api.resp.Body.Close()
+	if err != nil {
+		api.mdw.LogWeb().Error(err.Error())
+	}
+
+	api.body = body
+
+	return body
+}
+
+func (c *APIClient) decode(v interface{}) error {
+	api := c.api
+
+	body := api.responseBody()
+	if api.data == nil && api.err == nil {
+		api.data = api.decodeField(body)
+	}
+
+	if len(body) == 0 {
+		return errorEmptyResponse
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// result decodes the response if the API request has succeeded.
+// The request fails when the user has been redirected to refresh the auth,
+// so the handlers do not write anything over the redirect.
+func (c *APIClient) result(v interface{}) error {
+	api := c.api
+	if api.err != nil {
+		return api.err
+	}
+
+	if api.ctx.Writer.Written() {
+		api.err = redirectedErr
+		return api.err
+	}
+
+	// the data is still decoded, so the handlers may show the response anyway
+	err := c.decode(v)
+	if err != nil {
+		api.mdw.LogWeb().Warn("api",
+			zap.String("url", api.ctx.Request.URL.Path),
+			zap.Error(err),
+		)
+	}
+
+	return err
+}
+
+// Me returns the profile of the user.
+func (c *APIClient) Me() (*models.AuthProfile, error) {
+	c.api.MethodForwardTo(http.MethodGet, "/me", false)
+
+	me := &models.AuthProfile{}
+	err := c.result(me)
+
+	return me, err
+}
+
+// Entry returns the entry requested by the web request.
+func (c *APIClient) Entry() (*models.Entry, error) {
+	c.api.ForwardNoKey()
+
+	entry := &models.Entry{}
+	err := c.result(entry)
+
+	return entry, err
+}
+
+// CreateEntry posts the entry from the web request to the tlog of the user or the theme.
+func (c *APIClient) CreateEntry(theme string) (*models.Entry, error) {
+	if theme == "" {
+		c.api.ForwardTo("/me/tlog")
+	} else {
+		c.api.ForwardTo("/themes/" + theme + "/tlog")
+	}
+
+	entry := &models.Entry{}
+	err := c.result(entry)
+
+	return entry, err
+}
+
+// CreateTheme creates the theme from the web request.
+func (c *APIClient) CreateTheme() (*models.Profile, error) {
+	c.api.Forward()
+
+	theme := &models.Profile{}
+	err := c.result(theme)
+
+	return theme, err
+}
+
+// Comment forwards the web request to the comment with the method,
+// so it gets, posts or edits the comment.
+func (c *APIClient) Comment(method string) (*models.Comment, error) {
+	c.api.MethodForward(method)
+
+	cmt := &models.Comment{}
+	err := c.result(cmt)
+
+	return cmt, err
+}
+
+// Message forwards the web request to the message with the method,
+// so it gets, sends or edits the message.
+func (c *APIClient) Message(method string) (*models.Message, error) {
+	c.api.MethodForward(method)
+
+	msg := &models.Message{}
+	err := c.result(msg)
+
+	return msg, err
+}
+
+// Notification returns the notification requested by the web request.
+func (c *APIClient) Notification() (*models.Notification, error) {
+	c.api.Forward()
+
+	ntf := &models.Notification{}
+	err := c.result(ntf)
+
+	return ntf, err
+}
+
+// OAuth2 forwards the decision of the user on the app authorization.
+// The API error is returned both as the typed value and as the request error.
+func (c *APIClient) OAuth2(path string) (*OAuth2Code, *models.OAuth2Error, error) {
+	c.api.ForwardTo(path)
+
+	if c.api.StatusCode() == http.StatusOK && c.api.Error() == nil {
+		code := &OAuth2Code{}
+		err := c.result(code)
+		return code, nil, err
+	}
+
+	if c.api.StatusCode() == http.StatusBadRequest {
+		oauthErr := &models.OAuth2Error{}
+		if err := c.decode(oauthErr); err != nil {
+			return nil, nil, err
+		}
+
+		return nil, oauthErr, c.api.Error()
+	}
+
+	err := c.api.Error()
+	if err == nil {
+		err = errors.New("api: unexpected status " + http.StatusText(c.api.StatusCode()))
+	}
+
+	return nil, nil, err
+}
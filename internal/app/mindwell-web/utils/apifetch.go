@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FetchField is an API call which result is set to the data key.
+type FetchField struct {
+	// Path may contain a query which overrides the query of the web request.
+	Path       string
+	AllowNoKey bool
+	// Optional fields do not fail the request, like SetField followed by SkipError.
+	Optional bool
+}
+
+type fetchResult struct {
+	resp  *http.Response
+	body  []byte
+	err   error
+	cache string
+	begin time.Time
+	end   time.Time
+}
+
+// Fetch runs independent API calls concurrently and sets their results like SetField.
+// The error of the first failed required field in the key order becomes the request error,
+// so the outcome does not depend on the order the calls are finished in.
+// It returns the errors of all failed fields.
+func (api *APIRequest) Fetch(fields map[string]FetchField) map[string]error {
+	if api.err != nil {
+		return nil
+	}
+
+	if api.data == nil {
+		api.data = api.parseResponse()
+	}
+
+	if api.err != nil {
+		return nil
+	}
+
+	if api.data == nil {
+		api.data = map[string]interface{}{}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// requests are built before the concurrent part, since they are copied from the web request
+	reqs := make(map[string]*http.Request, len(fields))
+	for _, key := range keys {
+		field := fields[key]
+		if !api.setUserKey(field.AllowNoKey) {
+			api.data[key] = nil
+			continue
+		}
+
+		req, err := api.fetchRequest(field.Path)
+		if err != nil {
+			api.mdw.LogWeb().Error(err.Error())
+			continue
+		}
+
+		reqs[key] = req
+	}
+
+	results := make(map[string]*fetchResult, len(reqs))
+	for key := range reqs {
+		results[key] = &fetchResult{}
+	}
+
+	// the user key is checked before the concurrent part too
+	anonymous := !api.HasUserKey()
+
+	var wg sync.WaitGroup
+	for key, req := range reqs {
+		wg.Add(1)
+		go func(req *http.Request, res *fetchResult) {
+			defer wg.Done()
+			api.fetch(req, res, anonymous)
+		}(req, results[key])
+	}
+	wg.Wait()
+
+	errs := make(map[string]error)
+
+	for _, key := range keys {
+		res, ok := results[key]
+		if !ok {
+			continue
+		}
+
+		api.st.metrics = append(api.st.metrics, Metric{
+			Name:  key,
+			begin: res.begin.UnixNano(),
+			end:   res.end.UnixNano(),
+		})
+		if res.cache != "" {
+			api.st.Add(key + "-cache;desc=" + res.cache)
+		}
+
+		err := api.fetchError(res)
+		if err == nil {
+			api.data[key] = api.decodeField(res.body)
+			api.resp = res.resp
+			api.read = true
+			continue
+		}
+
+		errs[key] = err
+		if fields[key].Optional || api.err != nil {
+			continue
+		}
+
+		// keep the response unread, so the error page shows its message
+		if res.resp != nil {
+			res.resp.Body = io.NopCloser(bytes.NewReader(res.body))
+			api.resp = res.resp
+			api.read = false
+		}
+
+		if err == unavailableError {
+			api.setUnavailable()
+			continue
+		}
+
+		if res.err != nil {
+			api.SetData("code", 500)
+			api.SetData("message", "Произошла внутренняя ошибка")
+		} else if res.resp.StatusCode == http.StatusUnauthorized {
+			api.RequestRefreshAuth()
+		}
+
+		api.err = err
+	}
+
+	return errs
+}
+
+func (api *APIRequest) fetchRequest(path string) (*http.Request, error) {
+	link, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req := api.copyRequest(link.Path)
+	req.Method = http.MethodGet
+
+	if link.RawQuery != "" {
+		query := req.URL.Query()
+		for key, values := range link.Query() {
+			query[key] = values
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+
+	return req, nil
+}
+
+func (api *APIRequest) fetch(req *http.Request, res *fetchResult, anonymous bool) {
+	res.begin = time.Now()
+	defer func() { res.end = time.Now() }()
+
+	api.mdw.LogWeb().Debug("api",
+		zap.String("method", req.Method),
+		zap.String("url", req.URL.String()),
+	)
+
+	res.resp, res.cache, res.err = api.roundTrip(req, anonymous)
+	if res.err != nil {
+		api.mdw.LogWeb().Error(res.err.Error())
+		return
+	}
+
+	res.body, res.err = io.ReadAll(res.resp.Body)
+	_ = res.resp.Body.Close()
+	if res.err != nil {
+		api.mdw.LogWeb().Error(res.err.Error())
+	}
+}
+
+// fetchError maps the result to the errors set by checkError.
+func (api *APIRequest) fetchError(res *fetchResult) error {
+	if res.err == unavailableError {
+		return unavailableError
+	}
+
+	if res.err != nil {
+		return serverError
+	}
+
+	code := res.resp.StatusCode
+	switch {
+	case code == http.StatusUnauthorized:
+		return http.ErrNoCookie
+	case code >= 400 && code < 500:
+		return clientError
+	case code >= 500:
+		return serverError
+	}
+
+	return nil
+}
+
+func (api *APIRequest) decodeField(body []byte) map[string]interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewBuffer(body))
+	decoder.UseNumber()
+	var data map[string]interface{}
+	err := decoder.Decode(&data)
+	if err != nil {
+		api.mdw.LogWeb().Error(err.Error(),
+			zap.ByteString("json", body),
+		)
+	}
+
+	return data
+}
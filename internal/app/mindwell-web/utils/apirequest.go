@@ -18,7 +18,7 @@ import (
 )
 
 var mobReFull, mobRe4 *regexp.Regexp
-var clientError, serverError, csrfError, redirectedErr error
+var clientError, serverError, csrfError, redirectedErr, unavailableError error
 var requestBrowserID BrowserIDBuilder
 
 func init() {
@@ -29,20 +29,24 @@ func init() {
 	serverError = errors.New("server error")
 	csrfError = errors.New("csrf error")
 	redirectedErr = errors.New("redirected")
+	unavailableError = errors.New("api is unavailable")
 
 	requestBrowserID = NewDefaultBrowserIDBuilder()
 }
 
 type APIRequest struct {
-	mdw  *Mindwell
-	ctx  *gin.Context
-	err  error
-	resp *http.Response
-	read bool // whether resp is read
-	data map[string]interface{}
-	aTok string
-	uid2 string
-	st   *ServerTiming
+	mdw     *Mindwell
+	ctx     *gin.Context
+	err     error
+	resp    *http.Response
+	read    bool // whether resp is read
+	body    []byte
+	data    map[string]interface{}
+	aTok    string
+	uid2    string
+	appOnly bool       // whether user cookies are ignored
+	query   url.Values // the query of the app requests
+	st      *ServerTiming
 }
 
 func NewRequest(mdw *Mindwell, ctx *gin.Context) *APIRequest {
@@ -61,6 +65,23 @@ func NewRequest(mdw *Mindwell, ctx *gin.Context) *APIRequest {
 	return api
 }
 
+// NewAppRequest creates a request which always uses the app token,
+// so only public data is available regardless of the user cookies.
+// The query is sent to the API instead of the query of the web request.
+func NewAppRequest(mdw *Mindwell, ctx *gin.Context, query url.Values) *APIRequest {
+	st := NewServerTiming()
+	st.Add("api").Start()
+
+	return &APIRequest{
+		mdw:     mdw,
+		ctx:     ctx,
+		read:    false,
+		appOnly: true,
+		query:   query,
+		st:      st,
+	}
+}
+
 func (api *APIRequest) Server() *Mindwell {
 	return api.mdw
 }
@@ -240,7 +261,7 @@ func (api *APIRequest) setUserKey(allowNoKey bool) bool {
 		return false
 	}
 
-	if api.HasUserKey() {
+	if api.HasUserKey() || api.appOnly {
 		return true
 	}
 
@@ -300,15 +321,25 @@ func (api *APIRequest) RequestRefreshAuth() {
 }
 
 func (api *APIRequest) doNamed(req *http.Request, name string) {
-	defer api.st.Add(name).Start().Stop()
+	metric := api.st.Add(name).Start()
 
 	api.mdw.LogWeb().Debug("api",
 		zap.String("method", req.Method),
 		zap.String("url", req.URL.String()),
 	)
 
-	api.resp, api.err = http.DefaultTransport.RoundTrip(req)
-	if api.err != nil {
+	var cacheStatus string
+	api.resp, cacheStatus, api.err = api.roundTrip(req, !api.HasUserKey())
+
+	// the metric is stopped before the next one is added, since adding may move it
+	metric.Stop()
+	if cacheStatus != "" {
+		api.st.Add(name + "-cache;desc=" + cacheStatus)
+	}
+
+	if api.err == unavailableError {
+		api.setUnavailable()
+	} else if api.err != nil {
 		api.mdw.LogWeb().Error(api.err.Error())
 		api.err = nil
 		api.SetData("code", 500)
@@ -317,6 +348,25 @@ func (api *APIRequest) doNamed(req *http.Request, name string) {
 	}
 
 	api.read = false
+	api.body = nil
+}
+
+// roundTrip sends the request to the API. The anonymous requests to the cacheable paths
+// use the cache, then it returns the cache status.
+func (api *APIRequest) roundTrip(req *http.Request, anonymous bool) (*http.Response, string, error) {
+	if anonymous && api.mdw.apiCache.cacheable(req) {
+		return api.mdw.apiCache.RoundTrip(req)
+	}
+
+	resp, err := api.mdw.transport.RoundTrip(req)
+	return resp, "", err
+}
+
+func (api *APIRequest) setUnavailable() {
+	api.err = nil
+	api.SetData("code", 503)
+	api.SetData("message", "Сайт временно недоступен")
+	api.err = unavailableError
 }
 
 func (api *APIRequest) do(req *http.Request) {
@@ -451,6 +501,10 @@ func (api *APIRequest) copyRequestToHost(path, host string) *http.Request {
 	req.URL.Path = api.mdw.path + path
 	req.Close = false
 
+	if api.appOnly {
+		req.URL.RawQuery = api.query.Encode()
+	}
+
 	req.Header = make(map[string][]string)
 	headers := [...]string{"Accept", "Content-Length", "Content-Type", "Referer", "User-Agent", "X-Forwarded-For"}
 	for _, k := range headers {
@@ -597,6 +651,8 @@ func (api *APIRequest) readResponse() []byte {
 		api.mdw.LogWeb().Error(api.err.Error())
 	}
 
+	api.body = jsonData
+
 	return jsonData
 }
 
@@ -655,6 +711,11 @@ func (api *APIRequest) WriteTemplate(name string) {
 		name = "error"
 		api.ctx.Status(419)
 		break
+	case unavailableError:
+		name = "maintenance"
+		api.ctx.Status(503)
+		api.ctx.Header("Retry-After", strconv.Itoa(int(api.mdw.breaker.cooldown.Seconds())))
+		break
 	case redirectedErr:
 		return
 	case nil:
@@ -663,7 +724,7 @@ func (api *APIRequest) WriteTemplate(name string) {
 		return
 	}
 
-	if (name == "error" || name == "server_error") && (api.ExpectsJsonError() || !api.IsWebRequest()) {
+	if (name == "error" || name == "server_error" || name == "maintenance") && (api.ExpectsJsonError() || !api.IsWebRequest()) {
 		api.WriteJson()
 		return
 	}
@@ -679,6 +740,7 @@ func (api *APIRequest) WriteTemplate(name string) {
 	}
 
 	api.SetData("__large_screen", api.IsLargeScreen())
+	api.SetData("__embed_mode", api.EmbedMode())
 	api.SetData("__proto", api.mdw.ConfigString("web.proto"))
 	api.SetData("__domain", api.mdw.ConfigString("web.domain"))
 	api.SetData("__to_url", api.NextRedirect())
@@ -710,6 +772,20 @@ func (api *APIRequest) WriteTemplate(name string) {
 	templ.ExecuteWriter(api.Data(), api.ctx.Writer)
 }
 
+// WriteErrorTemplate renders the error page with the status set by the web server,
+// e.g. when the API has returned the data which must not be shown.
+func (api *APIRequest) WriteErrorTemplate(code int, message string) {
+	api.err = nil
+	api.resp = nil
+	api.data = map[string]interface{}{
+		"code":    code,
+		"message": message,
+	}
+
+	api.ctx.Status(code)
+	api.WriteTemplate("error")
+}
+
 func (api *APIRequest) WriteTemplateWithExtension(name string) {
 	var templ *pongo2.Template
 	templ, api.err = api.mdw.TemplateWithExtension(name)
@@ -728,7 +804,14 @@ func (api *APIRequest) WriteTemplateWithExtension(name string) {
 }
 
 func (api *APIRequest) WriteResponse() {
-	jsonData := api.readResponse()
+	if api.err == unavailableError {
+		api.ctx.Status(503)
+		api.WriteJson()
+		return
+	}
+
+	// the body may be already decoded by the client
+	jsonData := api.responseBody()
 	if api.resp == nil {
 		return
 	}
@@ -858,6 +941,17 @@ func (api *APIRequest) IsLargeScreen() bool {
 	return !mobRe4.MatchString(ua[:4])
 }
 
+// EmbedMode returns the media filter mode for the full content.
+// Readers may choose to show third-party embeds only on click.
+func (api *APIRequest) EmbedMode() string {
+	emb, err := api.ctx.Cookie("emb")
+	if err == nil && emb == "click" {
+		return "placeholder"
+	}
+
+	return "embed"
+}
+
 func (api *APIRequest) AppID() string {
 	return api.mdw.apiID
 }
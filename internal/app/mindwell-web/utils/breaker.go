@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Breaker stops calling the API after consecutive failures,
+// so pages fail fast while the server is down instead of waiting for timeouts.
+// After the cooldown a single request probes the server.
+type Breaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	log       *zap.Logger
+}
+
+func newBreaker(m *Mindwell) *Breaker {
+	threshold := m.ConfigInt("api.breaker_failures")
+	if threshold <= 0 {
+		threshold = 5
+	}
+
+	return &Breaker{
+		state:     BreakerClosed,
+		threshold: threshold,
+		cooldown:  m.configDuration("api.breaker_cooldown", 10*time.Second, time.Second),
+		log:       m.LogSystem(),
+	}
+}
+
+// Allow reports whether the request may be sent to the API.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+
+		b.setState(BreakerHalfOpen)
+		return true
+	case BreakerHalfOpen:
+		// the probe is in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// isCallerError reports whether the request has failed because the caller has cancelled it
+// or its own deadline has been exceeded, so the API is not to blame.
+func isCallerError(req *http.Request, err error) bool {
+	return errors.Is(err, context.Canceled) || req.Context().Err() != nil
+}
+
+// Done records the result of the request allowed by the breaker.
+func (b *Breaker) Done(req *http.Request, resp *http.Response, err error) {
+	if err != nil && isCallerError(req, err) {
+		b.skip()
+		return
+	}
+
+	failed := err != nil
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			failed = true
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		if b.state != BreakerOpen {
+			b.setState(BreakerOpen)
+		}
+	}
+}
+
+// skip ignores the result of the request. The probe gave no answer,
+// so the breaker opens again and the next request probes the server.
+func (b *Breaker) skip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *Breaker) setState(state string) {
+	b.state = state
+	b.log.Warn("api breaker",
+		zap.String("state", state),
+		zap.Int("failures", b.failures),
+	)
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// breakerTransport fails fast the requests to the API host while the breaker is open.
+// The image server is not watched, since it is not required to render pages.
+type breakerTransport struct {
+	base    http.RoundTripper
+	breaker *Breaker
+	host    string
+}
+
+func (bt *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != bt.host {
+		return bt.base.RoundTrip(req)
+	}
+
+	if !bt.breaker.Allow() {
+		return nil, unavailableError
+	}
+
+	resp, err := bt.base.RoundTrip(req)
+	bt.breaker.Done(req, resp, err)
+
+	return resp, err
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestBreaker() *Breaker {
+	return &Breaker{
+		state:     BreakerClosed,
+		threshold: 2,
+		cooldown:  time.Hour,
+		log:       zap.NewNop(),
+	}
+}
+
+func TestBreakerOpensOnFailures(t *testing.T) {
+	b := newTestBreaker()
+	req, _ := http.NewRequest(http.MethodGet, "http://api/entries/live", nil)
+
+	b.Done(req, nil, errors.New("connection refused"))
+	if b.State() != BreakerClosed {
+		t.Fatalf("got state %s after a failure", b.State())
+	}
+
+	b.Done(req, &http.Response{StatusCode: http.StatusBadGateway}, nil)
+	if b.State() != BreakerOpen {
+		t.Fatalf("got state %s after failures", b.State())
+	}
+
+	if b.Allow() {
+		t.Error("open breaker allows requests")
+	}
+}
+
+func TestBreakerIgnoresCallerErrors(t *testing.T) {
+	b := newTestBreaker()
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expiredCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequestWithContext(canceledCtx, http.MethodGet, "http://api/entries/live", nil)
+		b.Done(req, nil, context.Canceled)
+
+		req, _ = http.NewRequestWithContext(expiredCtx, http.MethodGet, "http://api/entries/live", nil)
+		b.Done(req, nil, context.DeadlineExceeded)
+
+		req, _ = http.NewRequest(http.MethodGet, "http://api/entries/live", nil)
+		b.Done(req, nil, context.Canceled)
+	}
+
+	if b.State() != BreakerClosed {
+		t.Errorf("got state %s after cancelled requests", b.State())
+	}
+
+	b.Done(&http.Request{}, nil, errors.New("timeout awaiting response headers"))
+	b.Done(&http.Request{}, nil, errors.New("timeout awaiting response headers"))
+	if b.State() != BreakerOpen {
+		t.Errorf("got state %s after server timeouts", b.State())
+	}
+}
+
+func TestBreakerCancelledProbe(t *testing.T) {
+	b := newTestBreaker()
+	b.state = BreakerOpen
+	b.cooldown = 0
+
+	if !b.Allow() || b.State() != BreakerHalfOpen {
+		t.Fatalf("probe is not allowed, state %s", b.State())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://api/entries/live", nil)
+	b.Done(req, nil, context.Canceled)
+
+	if !b.Allow() {
+		t.Error("cancelled probe blocks the next one")
+	}
+
+	b.Done(&http.Request{}, &http.Response{StatusCode: http.StatusOK}, nil)
+	if b.State() != BreakerClosed {
+		t.Errorf("got state %s after the successful probe", b.State())
+	}
+}
@@ -0,0 +1,99 @@
+package cachestore
+
+import (
+	"encoding/gob"
+	"errors"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Record is a cached value with the time it was loaded and last accessed.
+type Record struct {
+	Key    string
+	Value  []byte
+	Access time.Time
+	Load   time.Time
+}
+
+// Backend persists cache snapshots between restarts.
+type Backend interface {
+	Load() ([]Record, error)
+	Save(records []Record) error
+}
+
+// NewBackend returns the backend configured in the cache section
+// or nil if the caches are kept in memory only.
+func NewBackend(m *utils.Mindwell, name string) Backend {
+	dir := m.ConfigString("cache.dir")
+	if dir == "" {
+		return nil
+	}
+
+	return NewFileBackend(filepath.Join(dir, name+".gob"))
+}
+
+type fileBackend struct {
+	path string
+}
+
+// NewFileBackend stores snapshots in a single gob encoded file.
+func NewFileBackend(path string) Backend {
+	return &fileBackend{path: path}
+}
+
+func (fb *fileBackend) Load() ([]Record, error) {
+	file, err := os.Open(fb.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	var records []Record
+	err = gob.NewDecoder(file).Decode(&records)
+
+	return records, err
+}
+
+func (fb *fileBackend) Save(records []Record) error {
+	err := os.MkdirAll(filepath.Dir(fb.path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fb.path), filepath.Base(fb.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	err = gob.NewEncoder(tmp).Encode(records)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fb.path)
+}
+
+// Expiration returns the time the restored record should be kept in the cache for.
+// Stale records are kept for a while to be reloaded in background on the first access.
+func Expiration(rec Record, exp time.Duration) time.Duration {
+	left := time.Until(rec.Load.Add(exp))
+	if left < 24*time.Hour {
+		return 24 * time.Hour
+	}
+
+	return left
+}
@@ -0,0 +1,47 @@
+package cachestore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes the state of a cache for the admin page.
+type Stats struct {
+	Items  int
+	Hits   uint64
+	Misses uint64
+	// Dropped is the number of loads skipped since the queue was full.
+	Dropped uint64
+}
+
+// Counter counts cache hits and misses.
+type Counter struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func (c *Counter) Hit() {
+	c.hits.Add(1)
+}
+
+func (c *Counter) Miss() {
+	c.misses.Add(1)
+}
+
+func (c *Counter) Stats(items int) Stats {
+	return Stats{
+		Items:  items,
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+	}
+}
+
+// Info describes a cached entry.
+type Info struct {
+	Key      string
+	Provider string
+	Access   time.Time
+	Load     time.Time
+	Expires  time.Time
+	Pending  bool
+}
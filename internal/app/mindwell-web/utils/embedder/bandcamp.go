@@ -0,0 +1,73 @@
+package embedder
+
+import (
+	"fmt"
+	"github.com/sevings/mindwell-server/utils"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type bandcampProvider struct {
+	hrefRe *regexp.Regexp
+	cli    *http.Client
+	san    *HtmlSanitizer
+}
+
+func newBandcamp(cli *http.Client, san *HtmlSanitizer) *bandcampProvider {
+	return &bandcampProvider{
+		hrefRe: regexp.MustCompile(`^(?i)(?:https?://)?[\w\-]+\.bandcamp\.com/(?:album|track)/[\w\-]+/?(?:[?#].*)?$`),
+		cli:    cli,
+		san:    san,
+	}
+}
+
+// playerUrl checks that the player from the page metadata is hosted by Bandcamp.
+func playerUrl(player string) string {
+	u, err := url.Parse(player)
+	if err != nil || u.Scheme != "https" || strings.ToLower(u.Hostname()) != "bandcamp.com" ||
+		!strings.HasPrefix(u.Path, "/EmbeddedPlayer/") {
+		return ""
+	}
+
+	return u.String()
+}
+
+func (bp *bandcampProvider) Load(href string) (Embeddable, error) {
+	if !bp.hrefRe.MatchString(href) {
+		return nil, errorNoMatch
+	}
+
+	if !strings.Contains(href, "://") {
+		href = "https://" + href
+	}
+
+	meta, base, err := loadHtmlMeta(bp.cli, href)
+	if err != nil {
+		return nil, err
+	}
+
+	player := playerUrl(meta.first("og:video:secure_url", "og:video"))
+	if player == "" {
+		return nil, errorNoMatch
+	}
+
+	const template = `<iframe width="100%%" height="120" frameborder="0" src="%s"></iframe>`
+
+	oe := &OEmbed{
+		ProviderName: "Bandcamp",
+		Type:         "rich",
+		Url:          href,
+		ThumbnailUrl: secureUrl(base, meta.first("og:image")),
+		CacheAge:     7 * 24 * 60 * 60,
+	}
+
+	oe.Title, _ = utils.CutText(meta.first("og:title", "title"), 100)
+	oe.Description, _ = utils.CutText(meta.first("og:description"), 200)
+	oe.ID = strings.TrimPrefix(base.Path, "/")
+	oe.Html = embedHtml(bp.san, fmt.Sprintf(template, html.EscapeString(player)), oe.ProviderName, oe.ID)
+
+	return oe, nil
+}
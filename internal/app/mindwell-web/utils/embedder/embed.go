@@ -1,11 +1,19 @@
 package embedder
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/patrickmn/go-cache"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/cachestore"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/htmlwalk"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/mediaproxy"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/safehttp"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/workpool"
 	"go.uber.org/zap"
-	"net/http"
-	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,125 +25,457 @@ type Embeddable interface {
 	CacheControl() time.Duration
 }
 
+// thirdPartyEmbed is implemented by embeds which contact their provider as soon as they are shown.
+type thirdPartyEmbed interface {
+	Placeholder() string
+}
+
+// Placeholder returns the html shown to readers who load third-party content on click.
+func Placeholder(emb Embeddable) string {
+	if tp, ok := emb.(thirdPartyEmbed); ok {
+		return tp.Placeholder()
+	}
+
+	return emb.Embed()
+}
+
 type EmbeddableProvider interface {
 	Load(href string) (Embeddable, error)
 }
 
+// embedData is shared by the requests rendering the link and the reloading worker,
+// so its fields are accessed only under the mutex.
 type embedData struct {
-	emb    Embeddable
-	access time.Time
-	load   time.Time
+	mu       sync.RWMutex
+	emb      Embeddable
+	provider string
+	access   time.Time
+	load     time.Time
+	purged   bool
 }
 
 func newEmbedData(tag string) *embedData {
 	return &embedData{
-		emb: &NotEmbed{Tag: tag},
+		emb:    &NotEmbed{Tag: tag},
+		access: time.Now(),
+	}
+}
+
+// use marks the data as accessed and returns the current embed.
+func (data *embedData) use() Embeddable {
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	data.access = time.Now()
+	return data.emb
+}
+
+func (data *embedData) embed() Embeddable {
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+
+	return data.emb
+}
+
+func (data *embedData) times() (access, load time.Time) {
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+
+	return data.access, data.load
+}
+
+// set replaces the embed if it was loaded and updates the load time.
+func (data *embedData) set(emb Embeddable, provider string) Embeddable {
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	if emb != nil {
+		data.emb = emb
+		data.provider = provider
+	}
+	data.load = time.Now()
+
+	return data.emb
+}
+
+func (data *embedData) info(href string, exp time.Time) cachestore.Info {
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+
+	return cachestore.Info{
+		Key:      href,
+		Provider: data.provider,
+		Access:   data.access,
+		Load:     data.load,
+		Expires:  exp,
+	}
+}
+
+// purge prevents the data from being reloaded when it is evicted.
+func (data *embedData) purge() {
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	data.purged = true
+}
+
+func (data *embedData) isPurged() bool {
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+
+	return data.purged
+}
+
+// keep puts the data to the cache unless it has been purged. The mutex is held,
+// so the purge waits for it and then removes the data.
+func (data *embedData) keep(c *cache.Cache, href string, exp time.Duration) {
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+
+	if !data.purged {
+		c.Set(href, data, exp)
 	}
 }
 
 func (data *embedData) isUsed() bool {
-	return data.access.Add(180 * 24 * time.Hour).After(time.Now())
+	access, _ := data.times()
+	return access.Add(180 * 24 * time.Hour).After(time.Now())
 }
 
 func (data *embedData) isExpired() bool {
-	return data.load.Add(data.emb.CacheControl()).Before(time.Now())
+	_, load := data.times()
+	return load.Add(data.embed().CacheControl()).Before(time.Now())
+}
+
+// storedEmbed is the rendered embed restored from the persistent cache
+// or with images routed through the media proxy.
+type storedEmbed struct {
+	EmbedHtml       string
+	PreviewHtml     string
+	PlaceholderHtml string
+	Exp             time.Duration
+}
+
+func (se storedEmbed) Embed() string {
+	return se.EmbedHtml
+}
+
+func (se storedEmbed) Preview() string {
+	return se.PreviewHtml
+}
+
+func (se storedEmbed) Placeholder() string {
+	if se.PlaceholderHtml == "" {
+		return se.EmbedHtml
+	}
+
+	return se.PlaceholderHtml
+}
+
+func (se storedEmbed) CacheControl() time.Duration {
+	return se.Exp
+}
+
+// pendingEmbed is the original link rendered while the embed is being loaded.
+type pendingEmbed struct {
+	Tag string
+}
+
+func (pe pendingEmbed) mark(mode string) string {
+	return pe.Tag[:2] + ` data-embed-pending="` + mode + `"` + pe.Tag[2:]
+}
+
+func (pe pendingEmbed) Embed() string {
+	return pe.mark("embed")
+}
+
+func (pe pendingEmbed) Preview() string {
+	return pe.mark("preview")
+}
+
+func (pe pendingEmbed) Placeholder() string {
+	return pe.mark("placeholder")
+}
+
+func (pe pendingEmbed) CacheControl() time.Duration {
+	return 0
 }
 
 type Embedder struct {
-	eps    []EmbeddableProvider
-	cache  *cache.Cache
-	hrefRe *regexp.Regexp
-	aRe    *regexp.Regexp
-	log    *zap.Logger
+	eps   []EmbeddableProvider
+	cache *cache.Cache
+	store cachestore.Backend
+	pool  *workpool.Pool
+	proxy *mediaproxy.Proxy
+	stat  cachestore.Counter
+	log   *zap.Logger
 }
 
-func NewEmbedder(log *zap.Logger, domain string) *Embedder {
+func NewEmbedder(m *utils.Mindwell, log *zap.Logger, proxy *mediaproxy.Proxy) *Embedder {
 	e := &Embedder{
-		cache:  cache.New(180*24*time.Hour, 24*time.Hour),
-		hrefRe: regexp.MustCompile(`(?i)<a[^>]+href="([^"]+)"[^>]*>([^<]*)</a>`),
-		aRe:    regexp.MustCompile(`(?i)<a[^>]+>[^<]*</a>`),
-		log:    log,
+		cache: cache.New(180*24*time.Hour, 24*time.Hour),
+		store: cachestore.NewBackend(m, "embed"),
+		pool:  workpool.New(embedWorkers(m), 1024, log),
+		proxy: proxy,
+		log:   log,
 	}
 
 	e.cache.OnEvicted(func(href string, cached interface{}) {
 		data := cached.(*embedData)
+		if data.isPurged() {
+			return
+		}
 
-		if data.access.After(data.load) {
-			e.reload(href, data)
+		if access, load := data.times(); access.After(load) {
+			e.pool.Submit(href, func() { e.reload(href, data) })
 			return
 		}
 
 		if data.isUsed() {
-			e.cache.SetDefault(href, data)
+			data.keep(e.cache, href, cache.DefaultExpiration)
 		}
 	})
 
-	cli := &http.Client{Timeout: 2 * time.Second}
+	e.restore()
+
+	// links come from user content, so they must not reach internal services
+	cli := safehttp.NewClient(2*time.Second, 2*1024*1024,
+		"text/html", "application/xhtml+xml", "text/plain",
+		"application/json", "application/json+oembed", "text/json", "text/javascript")
+
+	oembedDomains := m.ConfigStrings("embed.oembed_domains")
+	iframeDomains := m.ConfigStrings("embed.iframe_domains")
+	san := NewHtmlSanitizer(append(iframeDomains, oembedDomains...))
+
+	e.AddProvider(newYouTube(cli, san))
+	e.AddProvider(newSoundCloud(cli, san))
+	e.AddProvider(newVimeo(cli, san))
+	e.AddProvider(newTickCounter(cli, san))
+	e.AddProvider(newRutube(cli, san))
+	e.AddProvider(newCoub(cli, san))
+	e.AddProvider(newVkVideo(cli, san))
+	e.AddProvider(newBandcamp(cli, san))
+	e.AddProvider(newTelegram(san))
+
+	if fileName := m.ConfigString("embed.providers"); fileName != "" {
+		providers, err := loadOEmbedRegistry(fileName, cli, san)
+		if err != nil {
+			log.Error("embed", zap.Error(err))
+		}
 
-	e.AddProvider(newYouTube(cli))
-	e.AddProvider(newSoundCloud(cli))
-	e.AddProvider(newVimeo(cli))
-	e.AddProvider(newTickCounter(cli))
-	e.AddProvider(newMindwell(domain))
-	e.AddProvider(newYandexMusic())
-	e.AddProvider(newHtmlProvider(cli))
+		for _, ep := range providers {
+			e.AddProvider(ep)
+		}
+	}
+
+	e.AddProvider(newMindwell(m, m.HttpClient(2*time.Second)))
+	e.AddProvider(newYandexMusic(san))
+	discovery := newOEmbedDiscovery(oembedDomains, cli, san)
+	e.AddProvider(newHtmlProvider(cli, discovery))
 
 	return e
 }
 
+func embedWorkers(m *utils.Mindwell) int {
+	workers := m.ConfigInt("embed.workers")
+	if workers <= 0 {
+		return 4
+	}
+
+	return workers
+}
+
+func cacheExpiration(emb Embeddable) time.Duration {
+	exp := emb.CacheControl()
+	if exp < 24*time.Hour {
+		exp = 24 * time.Hour
+	}
+
+	return exp
+}
+
+func (e *Embedder) restore() {
+	if e.store == nil {
+		return
+	}
+
+	records, err := e.store.Load()
+	if err != nil {
+		e.log.Error("embed", zap.Error(err))
+		return
+	}
+
+	for _, rec := range records {
+		emb := &storedEmbed{}
+		err = json.Unmarshal(rec.Value, emb)
+		if err != nil {
+			e.log.Warn("embed", zap.Error(err))
+			continue
+		}
+
+		data := &embedData{
+			emb:    emb,
+			access: rec.Access,
+			load:   rec.Load,
+		}
+
+		if data.isUsed() {
+			e.cache.Set(rec.Key, data, cachestore.Expiration(rec, cacheExpiration(emb)))
+		}
+	}
+
+	e.log.Info("embed",
+		zap.String("act", "restore"),
+		zap.Int("count", e.cache.ItemCount()))
+}
+
+// Save stores the cached embeds, so they are available after restart.
+func (e *Embedder) Save() error {
+	if e.store == nil {
+		return nil
+	}
+
+	items := e.cache.Items()
+	records := make([]cachestore.Record, 0, len(items))
+
+	for href, item := range items {
+		data := item.Object.(*embedData)
+		emb := data.embed()
+		value, err := json.Marshal(&storedEmbed{
+			EmbedHtml:       emb.Embed(),
+			PreviewHtml:     emb.Preview(),
+			PlaceholderHtml: Placeholder(emb),
+			Exp:             emb.CacheControl(),
+		})
+		if err != nil {
+			return err
+		}
+
+		access, load := data.times()
+		records = append(records, cachestore.Record{
+			Key:    href,
+			Value:  value,
+			Access: access,
+			Load:   load,
+		})
+	}
+
+	return e.store.Save(records)
+}
+
 func (e *Embedder) AddProvider(ep EmbeddableProvider) {
 	e.eps = append(e.eps, ep)
 }
 
 func (e *Embedder) EmbedAll(html string) string {
-	return e.aRe.ReplaceAllStringFunc(html, func(tag string) string {
-		return e.Convert(tag).Embed()
-	})
+	rw := htmlwalk.Rewriter{
+		Link: func(tag, href string) string {
+			return e.Convert(tag, href).Embed()
+		},
+	}
+
+	return rw.Rewrite(html)
 }
 
 func (e *Embedder) PreviewAll(html string) string {
-	return e.aRe.ReplaceAllStringFunc(html, func(tag string) string {
-		return e.Convert(tag).Preview()
-	})
+	rw := htmlwalk.Rewriter{
+		Link: func(tag, href string) string {
+			return e.Convert(tag, href).Preview()
+		},
+	}
+
+	return rw.Rewrite(html)
 }
 
-func min(x, y int) int {
-	if x < y {
-		return x
+// Convert returns the embed for the anchor tag whose text is its href.
+func (e *Embedder) Convert(tag, href string) Embeddable {
+	// providers insert the link into their html as is
+	if strings.ContainsAny(href, "\"'<> \t\n") {
+		return &NotEmbed{Tag: tag}
 	}
-	return y
+
+	cached, found := e.cache.Get(href)
+	if !found {
+		e.stat.Miss()
+		e.pool.Submit(href, func() {
+			e.reload(href, newEmbedData(tag))
+		})
+
+		return &pendingEmbed{Tag: tag}
+	}
+
+	e.stat.Hit()
+
+	data := cached.(*embedData)
+	if data.isExpired() {
+		// concurrent reloads of the same link are coalesced by the pool
+		e.pool.Submit(href, func() { e.reload(href, data) })
+	}
+
+	return data.use()
 }
 
-func (e *Embedder) Convert(tag string) Embeddable {
-	ht := e.hrefRe.FindAllStringSubmatch(tag, -1)
-	if len(ht) == 0 {
-		return &NotEmbed{Tag: tag}
+// Resolve returns the loaded embed for the link.
+// The second value is false if the link is still loading or unknown.
+func (e *Embedder) Resolve(href string) (Embeddable, bool) {
+	cached, found := e.cache.Get(href)
+	if !found {
+		return nil, false
 	}
 
-	href := ht[0][1]
-	text := ht[0][2]
+	data := cached.(*embedData)
 
-	compareLen := min(20, min(len(text), len(href)))
-	if compareLen == 0 || href[:compareLen] != text[:compareLen] {
-		return &NotEmbed{Tag: tag}
+	return data.use(), true
+}
+
+// IsPending reports whether the link is queued to be loaded.
+func (e *Embedder) IsPending(href string) bool {
+	return e.pool.IsPending(href)
+}
+
+// Stats returns the number of cached links and the hit rate.
+func (e *Embedder) Stats() cachestore.Stats {
+	stats := e.stat.Stats(e.cache.ItemCount())
+	stats.Dropped = e.pool.Dropped()
+
+	return stats
+}
+
+// Lookup describes the cached link.
+func (e *Embedder) Lookup(href string) (cachestore.Info, bool) {
+	cached, exp, found := e.cache.GetWithExpiration(href)
+	if !found {
+		return cachestore.Info{Key: href, Pending: e.IsPending(href)}, false
 	}
 
-	var data *embedData
+	info := cached.(*embedData).info(href, exp)
+	info.Pending = e.IsPending(href)
 
+	return info, true
+}
+
+// Purge removes the link from the cache, so it is loaded again when it is shown next time.
+func (e *Embedder) Purge(href string) bool {
 	cached, found := e.cache.Get(href)
-	if found {
-		data = cached.(*embedData)
-		if data.isExpired() {
-			go e.reload(href, data)
-		}
-	} else {
-		data = newEmbedData(tag)
-		e.reload(href, data)
+	if !found {
+		return false
 	}
 
-	data.access = time.Now()
+	cached.(*embedData).purge()
+	e.cache.Delete(href)
 
-	return data.emb
+	return true
+}
+
+// Reload loads the cached link again in background.
+func (e *Embedder) Reload(href string) bool {
+	cached, found := e.cache.Get(href)
+	if !found {
+		return false
+	}
+
+	data := cached.(*embedData)
+	return e.pool.Submit(href, func() { e.reload(href, data) })
 }
 
 func (e *Embedder) reload(href string, data *embedData) {
@@ -145,10 +485,12 @@ func (e *Embedder) reload(href string, data *embedData) {
 
 	var emb Embeddable
 	var err error
+	var provider string
 
 	for _, ep := range e.eps {
 		emb, err = ep.Load(href)
 		if err == nil {
+			provider = fmt.Sprintf("%T", ep)
 			break
 		}
 		if err != errorNoMatch {
@@ -156,16 +498,39 @@ func (e *Embedder) reload(href string, data *embedData) {
 		}
 	}
 
-	if err == nil {
-		data.emb = emb
+	if err != nil {
+		emb = nil
+	} else {
+		emb = e.proxyImages(emb)
 	}
 
-	data.load = time.Now()
+	emb = data.set(emb, provider)
 
-	exp := data.emb.CacheControl()
-	if exp < 24*time.Hour {
-		exp = 24 * time.Hour
+	// the link may be purged while it is loading
+	data.keep(e.cache, href, cacheExpiration(emb))
+}
+
+// proxyImages routes third-party images of the embed through the media proxy.
+func (e *Embedder) proxyImages(emb Embeddable) Embeddable {
+	if !e.proxy.IsEnabled() {
+		return emb
 	}
 
-	e.cache.Set(href, data, exp)
+	rw := htmlwalk.Rewriter{
+		Image: func(tag, src string) string {
+			proxied := e.proxy.URL(src)
+			if proxied == src {
+				return tag
+			}
+
+			return htmlwalk.SetImageSrc(tag, proxied)
+		},
+	}
+
+	return &storedEmbed{
+		EmbedHtml:       rw.Rewrite(emb.Embed()),
+		PreviewHtml:     rw.Rewrite(emb.Preview()),
+		PlaceholderHtml: rw.Rewrite(Placeholder(emb)),
+		Exp:             emb.CacheControl(),
+	}
 }
@@ -0,0 +1,321 @@
+package embedder
+
+import (
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/mediaproxy"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/workpool"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingProvider struct {
+	mu    sync.Mutex
+	loads map[string]int
+	fail  bool
+}
+
+func (cp *countingProvider) Load(href string) (Embeddable, error) {
+	time.Sleep(time.Millisecond)
+
+	cp.mu.Lock()
+	if cp.loads == nil {
+		cp.loads = make(map[string]int)
+	}
+	cp.loads[href]++
+	cp.mu.Unlock()
+
+	if cp.fail {
+		return nil, errors.New("load failed")
+	}
+
+	return &storedEmbed{
+		EmbedHtml:   `<div class="embed">` + href + `</div>`,
+		PreviewHtml: `<div class="preview">` + href + `</div>`,
+		Exp:         time.Hour,
+	}, nil
+}
+
+func (cp *countingProvider) count(href string) int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.loads[href]
+}
+
+type panicProvider struct{}
+
+func (panicProvider) Load(href string) (Embeddable, error) {
+	panic("broken provider")
+}
+
+func newTestEmbedder(eps ...EmbeddableProvider) *Embedder {
+	return &Embedder{
+		eps:   eps,
+		cache: cache.New(time.Hour, time.Hour),
+		pool:  workpool.New(4, 1024, zap.NewNop()),
+		proxy: &mediaproxy.Proxy{},
+		log:   zap.NewNop(),
+	}
+}
+
+func testLink(i int) (tag, href string) {
+	href = "https://example.com/" + strconv.Itoa(i)
+	return `<a href="` + href + `">` + href + `</a>`, href
+}
+
+func waitLoaded(t *testing.T, e *Embedder, hrefs ...string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, href := range hrefs {
+		for e.IsPending(href) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is still loading", href)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestEmbedderConcurrentConvert(t *testing.T) {
+	cp := &countingProvider{}
+	e := newTestEmbedder(cp)
+
+	const links = 10
+
+	var wg sync.WaitGroup
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < links; i++ {
+				tag, href := testLink(i)
+				e.Convert(tag, href).Embed()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var hrefs []string
+	for i := 0; i < links; i++ {
+		_, href := testLink(i)
+		hrefs = append(hrefs, href)
+	}
+	waitLoaded(t, e, hrefs...)
+
+	for _, href := range hrefs {
+		if n := cp.count(href); n != 1 {
+			t.Errorf("%s is loaded %d times", href, n)
+		}
+
+		emb, ok := e.Resolve(href)
+		if !ok {
+			t.Errorf("%s is not resolved", href)
+			continue
+		}
+
+		if want := `<div class="embed">` + href + `</div>`; emb.Embed() != want {
+			t.Errorf("%s: got %q, want %q", href, emb.Embed(), want)
+		}
+	}
+}
+
+func TestEmbedderConcurrentAdmin(t *testing.T) {
+	e := newTestEmbedder(&countingProvider{})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				tag, href := testLink(i % 5)
+				switch (g + i) % 6 {
+				case 0, 1:
+					e.Convert(tag, href)
+				case 2:
+					e.Reload(href)
+				case 3:
+					e.Purge(href)
+				case 4:
+					e.Lookup(href)
+					e.Stats()
+				case 5:
+					if emb, ok := e.Resolve(href); ok {
+						Placeholder(emb)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := 0; i < 5; i++ {
+		_, href := testLink(i)
+		waitLoaded(t, e, href)
+	}
+
+	if err := e.Save(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmbedderFailedLoadKeepsLink(t *testing.T) {
+	e := newTestEmbedder(&countingProvider{fail: true})
+
+	tag, href := testLink(1)
+	e.Convert(tag, href)
+	waitLoaded(t, e, href)
+
+	emb, ok := e.Resolve(href)
+	if !ok {
+		t.Fatal("the failed link is not cached")
+	}
+
+	if emb.Embed() != tag {
+		t.Errorf("got %q, want the original link", emb.Embed())
+	}
+}
+
+func TestEmbedderPanicInProvider(t *testing.T) {
+	cp := &countingProvider{}
+	e := newTestEmbedder(panicProvider{})
+
+	tag, href := testLink(1)
+	e.Convert(tag, href)
+	waitLoaded(t, e, href)
+
+	e.eps = []EmbeddableProvider{cp}
+
+	e.Convert(tag, href)
+	waitLoaded(t, e, href)
+
+	if _, ok := e.Resolve(href); !ok {
+		t.Error("the link is not loaded after the provider has panicked")
+	}
+}
+
+// blockingProvider loads the link only when the test releases it.
+type blockingProvider struct {
+	started chan string
+	release chan struct{}
+}
+
+func newBlockingProvider() *blockingProvider {
+	return &blockingProvider{
+		started: make(chan string),
+		release: make(chan struct{}),
+	}
+}
+
+func (bp *blockingProvider) Load(href string) (Embeddable, error) {
+	bp.started <- href
+	<-bp.release
+
+	return &storedEmbed{EmbedHtml: href, PreviewHtml: href, Exp: time.Hour}, nil
+}
+
+func (bp *blockingProvider) load() {
+	<-bp.started
+	bp.release <- struct{}{}
+}
+
+func TestEmbedderPurgeWhileLoading(t *testing.T) {
+	bp := newBlockingProvider()
+	e := newTestEmbedder(bp)
+	tag, href := testLink(1)
+
+	e.Convert(tag, href)
+	bp.load()
+	waitLoaded(t, e, href)
+
+	if !e.Reload(href) {
+		t.Fatal("the link is not reloaded")
+	}
+
+	<-bp.started
+	if !e.Purge(href) {
+		t.Fatal("the link is not purged")
+	}
+	bp.release <- struct{}{}
+	waitLoaded(t, e, href)
+
+	if _, found := e.cache.Get(href); found {
+		t.Fatal("the purged link is cached again")
+	}
+
+	e.Convert(tag, href)
+	bp.load()
+	waitLoaded(t, e, href)
+
+	cached, found := e.cache.Get(href)
+	if !found {
+		t.Fatal("the link is not loaded after the purge")
+	}
+	if cached.(*embedData).isPurged() {
+		t.Error("the purged data is cached")
+	}
+}
+
+func TestEmbedderReloadAfterPurge(t *testing.T) {
+	cp := &countingProvider{}
+	e := newTestEmbedder(cp)
+	tag, href := testLink(1)
+
+	e.Convert(tag, href)
+	waitLoaded(t, e, href)
+
+	if !e.Purge(href) {
+		t.Fatal("the link is not purged")
+	}
+	if e.Reload(href) {
+		t.Fatal("the purged link is reloaded")
+	}
+
+	e.Convert(tag, href)
+	waitLoaded(t, e, href)
+
+	if n := cp.count(href); n != 2 {
+		t.Errorf("%s is loaded %d times", href, n)
+	}
+	if _, ok := e.Resolve(href); !ok {
+		t.Error("the link is not loaded after the purge")
+	}
+}
+
+func TestEmbedderConcurrentPurgeAndReload(t *testing.T) {
+	e := newTestEmbedder(&countingProvider{})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tag, href := testLink(i % 3)
+				switch (g + i) % 3 {
+				case 0:
+					e.Convert(tag, href)
+				case 1:
+					e.Reload(href)
+				case 2:
+					e.Purge(href)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := 0; i < 3; i++ {
+		_, href := testLink(i)
+		waitLoaded(t, e, href)
+
+		if cached, found := e.cache.Get(href); found && cached.(*embedData).isPurged() {
+			t.Errorf("the purged data of %s is cached", href)
+		}
+	}
+}
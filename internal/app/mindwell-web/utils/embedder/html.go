@@ -3,84 +3,263 @@ package embedder
 import (
 	"fmt"
 	"github.com/sevings/mindwell-server/utils"
+	"golang.org/x/net/html"
 	"golang.org/x/net/html/charset"
 	"io"
 	"net/http"
-	"regexp"
+	"net/url"
 	"strings"
 	"time"
 )
 
+// maxHtmlSize limits the amount of a page read to find its metadata.
+const maxHtmlSize = 512 * 1024
+
 type htmlEmbed struct {
-	html string
+	Url         string
+	Title       string
+	Description string
+	Image       string
+	SiteName    string
+	Icon        string
 }
 
 func (h htmlEmbed) Embed() string {
-	return h.html
+	return h.card()
 }
 
 func (h htmlEmbed) Preview() string {
-	return h.html
+	return h.card()
 }
 
 func (h htmlEmbed) CacheControl() time.Duration {
 	return 24 * time.Hour
 }
 
+func (h htmlEmbed) card() string {
+	if h.Description == "" && h.Image == "" {
+		return fmt.Sprintf(`<a href="%s" target="_blank">%s</a>`, h.Url, html.EscapeString(h.Title))
+	}
+
+	var thumb string
+	if h.Image != "" {
+		const thumbTemplate = `
+	<div class="video-thumb">
+		<a href="%s" target="_blank"><img src="%s" alt="%s"></a>
+	</div>
+`
+		thumb = fmt.Sprintf(thumbTemplate, h.Url, html.EscapeString(h.Image), html.EscapeString(h.Title))
+	}
+
+	var icon string
+	if h.Icon != "" {
+		icon = fmt.Sprintf(`<img class="link-icon" src="%s" alt="" width="16" height="16"> `,
+			html.EscapeString(h.Icon))
+	}
+
+	const template = `
+<div class="post-video">%s
+	<div class="video-content">
+		<a href="%s" class="h4 title" target="_blank">%s</a>
+		<p>%s</p>
+		<a href="%s" class="link-site" target="_blank">%s%s</a>
+	</div>
+</div>
+`
+
+	return fmt.Sprintf(template, thumb, h.Url, html.EscapeString(h.Title),
+		html.EscapeString(h.Description), h.Url, icon, html.EscapeString(h.SiteName))
+}
+
 type htmlProvider struct {
-	titleRe *regexp.Regexp
-	cli     *http.Client
+	cli       *http.Client
+	discovery *oembedDiscovery
 }
 
-func newHtmlProvider(cli *http.Client) *htmlProvider {
+func newHtmlProvider(cli *http.Client, discovery *oembedDiscovery) *htmlProvider {
 	return &htmlProvider{
-		titleRe: regexp.MustCompile(`(?i)<title[^>]*>([^<]*)</title>`),
-		cli:     cli,
+		cli:       cli,
+		discovery: discovery,
 	}
 }
 
-func (hp *htmlProvider) Load(href string) (Embeddable, error) {
+// loadHtmlMeta requests the page and parses its head.
+// It also returns the page url after redirects.
+func loadHtmlMeta(cli *http.Client, href string) (htmlMeta, *url.URL, error) {
 	req, err := http.NewRequest("GET", href, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	req.Header.Set("Accept", "text/html, application/xhtml+xml")
 	req.Header.Set("User-Agent", "mindwell-web")
 
-	resp, err := hp.cli.Do(req)
+	resp, err := cli.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
-		return nil, errorNoMatch
+		return nil, nil, errorNoMatch
 	}
 
 	contentType := resp.Header.Get("content-type")
 	if !strings.Contains(contentType, "html") {
-		return nil, errorNoMatch
+		return nil, nil, errorNoMatch
 	}
 
-	defer resp.Body.Close()
-	htmlReader, err := charset.NewReader(resp.Body, contentType)
+	body := io.LimitReader(resp.Body, maxHtmlSize)
+	htmlReader, err := charset.NewReader(body, contentType)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	html, err := io.ReadAll(htmlReader)
+	return parseHtmlMeta(htmlReader), resp.Request.URL, nil
+}
+
+func (hp *htmlProvider) Load(href string) (Embeddable, error) {
+	meta, base, err := loadHtmlMeta(hp.cli, href)
 	if err != nil {
 		return nil, err
 	}
 
-	match := hp.titleRe.FindSubmatch(html)
-	if len(match) == 0 {
+	if endpoint := meta.first("oembed"); endpoint != "" {
+		oembed, err := hp.discovery.Load(href, secureUrl(base, endpoint))
+		if err == nil {
+			return oembed, nil
+		}
+	}
+
+	emb := &htmlEmbed{
+		Url:         href,
+		Title:       meta.first("og:title", "twitter:title", "title"),
+		Description: meta.first("og:description", "twitter:description", "description"),
+		SiteName:    meta.first("og:site_name", "twitter:site"),
+	}
+
+	if emb.Title == "" {
 		return nil, errorNoMatch
 	}
 
-	title := string(match[1])
-	title, _ = utils.CutText(title, 100)
+	emb.Title, _ = utils.CutText(emb.Title, 100)
+	emb.Description, _ = utils.CutText(emb.Description, 200)
+	emb.SiteName, _ = utils.CutText(emb.SiteName, 50)
+
+	if emb.SiteName == "" {
+		emb.SiteName = base.Hostname()
+	}
+
+	image := meta.first("og:image:secure_url", "og:image", "twitter:image", "twitter:image:src")
+	emb.Image = secureUrl(base, image)
+	emb.Icon = secureUrl(base, meta.first("icon"))
+
+	return emb, nil
+}
+
+// secureUrl resolves the link against the page url.
+// Media from insecure origins would break the page, so they are dropped.
+func secureUrl(base *url.URL, link string) string {
+	if link == "" {
+		return ""
+	}
+
+	ref, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return ""
+	}
+
+	abs := base.ResolveReference(ref)
+	if abs.Scheme != "https" {
+		return ""
+	}
+
+	return abs.String()
+}
+
+type htmlMeta map[string]string
 
-	tag := fmt.Sprintf(`<a href="%s" target="_blank">%s</a>`, href, title)
-	return &htmlEmbed{html: tag}, nil
+func (meta htmlMeta) first(keys ...string) string {
+	for _, key := range keys {
+		value := strings.TrimSpace(meta[key])
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func (meta htmlMeta) set(key, value string) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if key == "" {
+		return
+	}
+
+	if _, found := meta[key]; !found {
+		meta[key] = value
+	}
+}
+
+// parseHtmlMeta collects the title, meta tags, the icon and the oEmbed endpoint from the page head.
+func parseHtmlMeta(r io.Reader) htmlMeta {
+	meta := make(htmlMeta)
+	z := html.NewTokenizer(r)
+
+	var inTitle bool
+	var title strings.Builder
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			meta.set("title", title.String())
+			return meta
+		case html.TextToken:
+			if inTitle {
+				title.Write(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				meta.set("title", title.String())
+				return meta
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := make(map[string]string)
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(value)
+			}
+
+			switch string(name) {
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "meta":
+				if property := attrs["property"]; property != "" {
+					meta.set(property, attrs["content"])
+				} else {
+					meta.set(attrs["name"], attrs["content"])
+				}
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+					switch {
+					case rel == "icon":
+						meta.set("icon", attrs["href"])
+					case rel == "alternate" && attrs["type"] == "application/json+oembed":
+						meta.set("oembed", attrs["href"])
+					}
+				}
+			case "body":
+				meta.set("title", title.String())
+				return meta
+			}
+		}
+	}
 }
@@ -1,18 +1,30 @@
 package embedder
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/sevings/mindwell-server/models"
+	"github.com/sevings/mindwell-server/utils"
+	webUtils "github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"html"
+	"io"
+	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type mindwellEmbed struct {
 	tag string
+	exp time.Duration
 }
 
 func newMindwellEmbed(href, title string) *mindwellEmbed {
 	return &mindwellEmbed{
-		tag: fmt.Sprintf(`<a href="%s" target="_blank">%s</a>`, href, title),
+		tag: fmt.Sprintf(`<a href="%s" target="_blank">%s</a>`, href, html.EscapeString(title)),
+		exp: 720 * time.Hour,
 	}
 }
 
@@ -25,18 +37,46 @@ func (mwe mindwellEmbed) Preview() string {
 }
 
 func (mwe mindwellEmbed) CacheControl() time.Duration {
-	return 720 * time.Hour
+	return mwe.exp
 }
 
+type mindwellCard struct {
+	embed   string
+	preview string
+	exp     time.Duration
+}
+
+func (mwc mindwellCard) Embed() string {
+	return mwc.embed
+}
+
+func (mwc mindwellCard) Preview() string {
+	return mwc.preview
+}
+
+func (mwc mindwellCard) CacheControl() time.Duration {
+	return mwc.exp
+}
+
+var errorNotVisible = errors.New("mindwell: the link is not public")
+
 type mindwellProvider struct {
-	domain string
-	hrefRe *regexp.Regexp
+	cli     *http.Client
+	mi      *webUtils.Mindwell
+	domain  string
+	baseUrl string
+	hrefRe  *regexp.Regexp
 }
 
-func newMindwell(domain string) *mindwellProvider {
+func newMindwell(m *webUtils.Mindwell, cli *http.Client) *mindwellProvider {
+	domain := m.ConfigString("web.domain")
+
 	return &mindwellProvider{
-		domain: domain,
-		hrefRe: regexp.MustCompile(`(?i)(?:https?://)?(?:www\.)?([^/]+)/([^/]+)(?:/([^/]+))?.*`),
+		cli:     cli,
+		mi:      m,
+		domain:  domain,
+		baseUrl: m.ConfigString("web.proto") + "://" + domain,
+		hrefRe:  regexp.MustCompile(`(?i)(?:https?://)?(?:www\.)?([^/]+)/([^/?#]+)(?:/([^/?#]+))?.*`),
 	}
 }
 
@@ -52,15 +92,247 @@ func (mp *mindwellProvider) Load(href string) (Embeddable, error) {
 	}
 
 	dir := match[2]
+	name := match[3]
 	switch dir {
 	case "entries":
-		return newMindwellEmbed(href, "Запись — Mindwell"), nil
-	case "users":
-		user := match[3]
-		if len(user) > 0 {
-			return newMindwellEmbed(href, user+" — Mindwell"), nil
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			return newMindwellEmbed(href, "Запись — Mindwell"), nil
 		}
+
+		emb, err := mp.loadEntry(href, id)
+		if err == errorNotVisible {
+			return mp.hiddenEmbed(href, "Запись — Mindwell"), nil
+		}
+
+		return emb, err
+	case "users", "themes":
+		if len(name) == 0 {
+			break
+		}
+
+		emb, err := mp.loadProfile(href, dir, name)
+		if err == errorNotVisible {
+			return mp.hiddenEmbed(href, name+" — Mindwell"), nil
+		}
+
+		return emb, err
 	}
 
 	return nil, errorNoMatch
 }
+
+// hiddenEmbed returns the plain link for entries and tlogs that are not public.
+// The privacy may change, so it is rechecked more often.
+func (mp *mindwellProvider) hiddenEmbed(href, title string) *mindwellEmbed {
+	emb := newMindwellEmbed(href, title)
+	emb.exp = 24 * time.Hour
+	return emb
+}
+
+func (mp *mindwellProvider) loadJson(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, mp.mi.ApiUrl()+path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+mp.mi.AppToken())
+	resp, err := mp.cli.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return errorNotVisible
+	default:
+		return fmt.Errorf("mindwell: %s: %s", resp.Status, string(body))
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// cardText converts the HTML from the API to escaped plain text of the given length.
+func cardText(text string, size int) string {
+	text = utils.RemoveHTML(text)
+	text = html.UnescapeString(text)
+	text = strings.Join(strings.Fields(text), " ")
+
+	text, isCut := utils.CutText(text, size)
+	if isCut {
+		text += "…"
+	}
+
+	return html.EscapeString(text)
+}
+
+func tlogPath(user *models.User) string {
+	if user.IsTheme {
+		return "/themes/" + user.Name
+	}
+
+	return "/users/" + user.Name
+}
+
+func (mp *mindwellProvider) loadEntry(href string, id int64) (Embeddable, error) {
+	entry := &models.Entry{}
+	err := mp.loadJson("/entries/"+strconv.FormatInt(id, 10), entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Privacy != "all" {
+		return nil, errorNotVisible
+	}
+
+	title := entry.Title
+	if title == "" {
+		title = entry.CutTitle
+	}
+	title = cardText(title, 100)
+
+	content := entry.CutContent
+	if content == "" {
+		content = entry.Content
+	}
+	previewText := cardText(content, 200)
+	embedText := cardText(content, 500)
+
+	if title == "" {
+		title = "Запись"
+	}
+
+	var rating int64
+	if entry.Rating != nil {
+		rating = entry.Rating.UpCount - entry.Rating.DownCount
+	}
+
+	var authorName, authorUrl, avatar string
+	if entry.Author != nil && !entry.IsAnonymous {
+		authorName = cardText(entry.Author.ShowName, 50)
+		authorUrl = mp.baseUrl + tlogPath(entry.Author)
+		if entry.Author.Avatar != nil {
+			avatar = entry.Author.Avatar.X42
+		}
+	} else {
+		authorName = "Анонимный автор"
+	}
+
+	var author string
+	if authorUrl == "" {
+		author = fmt.Sprintf(`<span class="h6 post__author-name fn">%s</span>`, authorName)
+	} else {
+		const authorTag = `
+<a href="%s" target="_blank">
+	<img src="%s" alt="%s">
+</a>
+<a class="h6 post__author-name fn" href="%s" target="_blank">%s</a>`
+
+		author = fmt.Sprintf(authorTag, authorUrl, avatar, authorName, authorUrl, authorName)
+	}
+
+	const previewTag = `
+<div class="post-video mindwell-card">
+	<div class="video-content">
+		<a href="%s" class="h4 title" target="_blank">%s</a>
+		<p>%s</p>
+		<a href="%s" class="link-site" target="_blank">%s · рейтинг %d</a>
+	</div>
+</div>
+`
+
+	const embedTag = `
+<div class="post-video mindwell-card mindwell-card--entry">
+	<div class="video-content">
+		<div class="post__author author vcard inline-items">%s</div>
+		<a href="%s" class="h4 title" target="_blank">%s</a>
+		<p>%s</p>
+		<div class="mindwell-card__info">
+			<span title="Рейтинг">&#9733; %d</span>
+			<span title="Комментарии">&#128172; %d</span>
+			<a href="%s" class="link-site" target="_blank">Mindwell</a>
+		</div>
+	</div>
+</div>
+`
+
+	return &mindwellCard{
+		preview: fmt.Sprintf(previewTag, href, title, previewText, href, authorName, rating),
+		embed: fmt.Sprintf(embedTag, author, href, title, embedText,
+			rating, entry.CommentCount, href),
+		exp: 6 * time.Hour,
+	}, nil
+}
+
+func (mp *mindwellProvider) loadProfile(href, dir, name string) (Embeddable, error) {
+	profile := &models.Profile{}
+	err := mp.loadJson("/"+dir+"/"+name, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	if profile.Privacy != "all" {
+		return nil, errorNotVisible
+	}
+
+	showName := cardText(profile.ShowName, 50)
+	title := cardText(profile.Title, 200)
+
+	var avatar string
+	if profile.Avatar != nil {
+		avatar = profile.Avatar.X92
+	}
+
+	rank := "—"
+	if profile.Rank > 0 {
+		rank = strconv.FormatFloat(profile.Rank, 'f', 0, 64)
+	}
+
+	var entries int64
+	if profile.Counts != nil {
+		entries = profile.Counts.Entries
+	}
+
+	const previewTag = `
+<div class="post-video mindwell-card">
+	<div class="video-content">
+		<a href="%s" class="h4 title" target="_blank">%s</a>
+		<p>%s</p>
+		<a href="%s" class="link-site" target="_blank">Mindwell · место в рейтинге %s</a>
+	</div>
+</div>
+`
+
+	const embedTag = `
+<div class="post-video mindwell-card mindwell-card--profile">
+	<div class="video-thumb">
+		<a href="%s" target="_blank">
+			<img src="%s" alt="%s">
+		</a>
+	</div>
+	<div class="video-content">
+		<a href="%s" class="h4 title" target="_blank">%s</a>
+		<p>%s</p>
+		<div class="mindwell-card__info">
+			<span title="Место в рейтинге">&#9733; %s</span>
+			<span title="Записи">&#9998; %d</span>
+			<a href="%s" class="link-site" target="_blank">Mindwell</a>
+		</div>
+	</div>
+</div>
+`
+
+	return &mindwellCard{
+		preview: fmt.Sprintf(previewTag, href, showName, title, href, rank),
+		embed: fmt.Sprintf(embedTag, href, avatar, showName, href, showName, title,
+			rank, entries, href),
+		exp: 24 * time.Hour,
+	}, nil
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/sevings/mindwell-server/utils"
+	"html"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -32,13 +33,15 @@ type OEmbedProvider struct {
 	hrefRe *regexp.Regexp
 	apiUrl string
 	cli    *http.Client
+	san    *HtmlSanitizer
 }
 
-func NewOEmbedProvider(hrefRe, apiUrl string, cli *http.Client) *OEmbedProvider {
+func NewOEmbedProvider(hrefRe, apiUrl string, cli *http.Client, san *HtmlSanitizer) *OEmbedProvider {
 	return &OEmbedProvider{
 		hrefRe: regexp.MustCompile(hrefRe),
 		apiUrl: apiUrl,
 		cli:    cli,
+		san:    san,
 	}
 }
 
@@ -75,20 +78,33 @@ func (oep *OEmbedProvider) LoadChecked(href string) (*OEmbed, error) {
 
 	oembed.Description, _ = utils.CutText(oembed.Description, 200)
 
-	if oembed.Url == "" {
+	// the url is rendered as the link, so only the web pages are accepted
+	if !isHttpUrl(oembed.Url) {
 		oembed.Url = href
 	}
 
+	if !isHttpUrl(oembed.ThumbnailUrl) {
+		oembed.ThumbnailUrl = ""
+	}
+
 	sum := md5.Sum([]byte(oembed.Url))
 	oembed.ID = base64.URLEncoding.EncodeToString(sum[:])
 
-	const template = `<iframe class="embed" data-provider="%s" data-embed="%s"`
-	htmlStart := fmt.Sprintf(template, oembed.ProviderName, oembed.ID)
-	oembed.Html = strings.Replace(oembed.Html, "<iframe", htmlStart, 1)
+	oembed.Html = embedHtml(oep.san, oembed.Html, oembed.ProviderName, oembed.ID)
 
 	return oembed, nil
 }
 
+// embedHtml sanitizes the provider html and marks its iframe for the embed scripts.
+func embedHtml(san *HtmlSanitizer, content, provider, id string) string {
+	content = san.Sanitize(content)
+
+	const template = `<iframe class="embed" data-provider="%s" data-embed="%s"`
+	htmlStart := fmt.Sprintf(template, html.EscapeString(provider), html.EscapeString(id))
+
+	return strings.Replace(content, "<iframe", htmlStart, 1)
+}
+
 func (oe *OEmbed) Embed() string {
 	return oe.Html
 }
@@ -111,7 +127,9 @@ func (oe *OEmbed) PreviewVideo() string {
 </div>
 `
 
-	return fmt.Sprintf(template, oe.ThumbnailUrl, oe.Url, oe.ID, oe.Title, oe.Description, oe.Url, oe.ProviderName)
+	href := html.EscapeString(oe.Url)
+	return fmt.Sprintf(template, html.EscapeString(oe.ThumbnailUrl), href, oe.ID,
+		html.EscapeString(oe.Title), html.EscapeString(oe.Description), href, html.EscapeString(oe.ProviderName))
 }
 
 func (oe *OEmbed) PreviewRich() string {
@@ -125,7 +143,8 @@ func (oe *OEmbed) PreviewRich() string {
 </div>
 `
 
-	return fmt.Sprintf(template, oe.Title, oe.Description, oe.Url, oe.ProviderName)
+	return fmt.Sprintf(template, html.EscapeString(oe.Title), html.EscapeString(oe.Description),
+		html.EscapeString(oe.Url), html.EscapeString(oe.ProviderName))
 }
 
 func (oe *OEmbed) Preview() string {
@@ -136,6 +155,39 @@ func (oe *OEmbed) Preview() string {
 	}
 }
 
+// Placeholder renders the preview card which shows the embed on click,
+// so the provider is not contacted until the reader asks for it.
+func (oe *OEmbed) Placeholder() string {
+	return oe.placeholder(oe.Html)
+}
+
+func (oe *OEmbed) placeholder(embed string) string {
+	if !strings.Contains(embed, "<iframe") {
+		return embed
+	}
+
+	var thumb string
+	if oe.ThumbnailUrl != "" {
+		thumb = fmt.Sprintf(`<div class="video-thumb"><img src="%s" alt="photo"></div>`, html.EscapeString(oe.ThumbnailUrl))
+	}
+
+	const template = `
+<div class="post-video embed-placeholder">
+	%s
+	<div class="video-content">
+		<span class="h4 title">%s</span>
+		<p>%s</p>
+		<button type="button" class="btn btn-sm btn-primary load-embed">Загрузить контент с сайта %s</button>
+		<a href="%s" class="link-site" target="_blank" rel="noopener noreferrer">%s</a>
+	</div>
+	<template>%s</template>
+</div>
+`
+
+	return fmt.Sprintf(template, thumb, html.EscapeString(oe.Title), html.EscapeString(oe.Description),
+		html.EscapeString(oe.ProviderName), html.EscapeString(oe.Url), html.EscapeString(oe.Url), embed)
+}
+
 func (oe *OEmbed) CacheControl() time.Duration {
 	if oe.CacheAge > 0 {
 		return time.Duration(oe.CacheAge) * time.Second
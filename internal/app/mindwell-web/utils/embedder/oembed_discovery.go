@@ -0,0 +1,114 @@
+package embedder
+
+import (
+	"errors"
+	"golang.org/x/net/html"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errorUntrusted = errors.New("oembed: the provider is not trusted")
+
+// oembedDiscovery loads oEmbed data from endpoints advertised by pages themselves.
+// Only providers from the allowlist are used, as their html is embedded as is.
+type oembedDiscovery struct {
+	domains []string
+	cli     *http.Client
+	san     *HtmlSanitizer
+}
+
+func newOEmbedDiscovery(domains []string, cli *http.Client, san *HtmlSanitizer) *oembedDiscovery {
+	od := &oembedDiscovery{
+		cli: cli,
+		san: san,
+	}
+
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, ". "))
+		if domain != "" {
+			od.domains = append(od.domains, domain)
+		}
+	}
+
+	return od
+}
+
+func (od *oembedDiscovery) isTrusted(host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range od.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Load requests the discovered endpoint for the page href.
+func (od *oembedDiscovery) Load(href, endpoint string) (Embeddable, error) {
+	api, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if api.Scheme != "https" || !od.isTrusted(api.Hostname()) {
+		return nil, errorUntrusted
+	}
+
+	query := api.Query()
+	query.Del("url")
+	query.Set("format", "json")
+	api.RawQuery = query.Encode()
+
+	ep := NewOEmbedProvider(".*", api.String()+"&url=", od.cli, od.san)
+	oembed, err := ep.LoadChecked(href)
+	if err != nil {
+		return nil, err
+	}
+
+	if oembed.Type != "video" && oembed.Type != "rich" {
+		return nil, errorNoMatch
+	}
+
+	if oembed.Html == "" || !od.hasTrustedSources(oembed.Html) {
+		return nil, errorUntrusted
+	}
+
+	return oembed, nil
+}
+
+// hasTrustedSources checks that all frames and scripts are loaded from the allowed domains.
+func (od *oembedDiscovery) hasTrustedSources(content string) bool {
+	z := html.NewTokenizer(strings.NewReader(content))
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return true
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "iframe" && string(name) != "script" {
+				continue
+			}
+
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				switch string(key) {
+				case "srcdoc":
+					return false
+				case "src":
+					src, err := url.Parse(string(value))
+					if err != nil || (src.Scheme != "https" && src.Scheme != "") {
+						return false
+					}
+					if !od.isTrusted(src.Hostname()) {
+						return false
+					}
+				}
+			}
+		}
+	}
+}
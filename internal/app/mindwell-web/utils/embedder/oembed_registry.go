@@ -0,0 +1,88 @@
+package embedder
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// oembedRegistryEntry is a provider description in the oembed.com providers.json format.
+type oembedRegistryEntry struct {
+	ProviderName string `json:"provider_name"`
+	ProviderUrl  string `json:"provider_url"`
+	Endpoints    []struct {
+		Schemes []string `json:"schemes"`
+		Url     string   `json:"url"`
+	} `json:"endpoints"`
+}
+
+// schemeRe converts the oEmbed url scheme with wildcards to a regular expression.
+func schemeRe(scheme string) string {
+	scheme = strings.TrimSpace(scheme)
+	scheme = strings.TrimPrefix(scheme, "http://")
+	scheme = strings.TrimPrefix(scheme, "https://")
+
+	re := regexp.QuoteMeta(scheme)
+	re = strings.ReplaceAll(re, `\*`, `.*`)
+
+	return `(?:https?://)?` + re
+}
+
+// endpointUrl prepares the endpoint to be used as OEmbedProvider.apiUrl.
+func endpointUrl(endpoint string) string {
+	if strings.Contains(endpoint, "{format}") {
+		endpoint = strings.ReplaceAll(endpoint, "{format}", "json")
+	} else if strings.Contains(endpoint, "?") {
+		endpoint += "&format=json"
+	} else {
+		endpoint += "?format=json"
+	}
+
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&url="
+	}
+
+	return endpoint + "?url="
+}
+
+// loadOEmbedRegistry creates providers from the file in the oembed.com providers.json format.
+func loadOEmbedRegistry(fileName string, cli *http.Client, san *HtmlSanitizer) ([]EmbeddableProvider, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []oembedRegistryEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []EmbeddableProvider
+
+	for _, entry := range entries {
+		for _, endpoint := range entry.Endpoints {
+			if endpoint.Url == "" || len(endpoint.Schemes) == 0 {
+				continue
+			}
+
+			var schemes []string
+			for _, scheme := range endpoint.Schemes {
+				schemes = append(schemes, schemeRe(scheme))
+			}
+
+			hrefRe := `(?i)^(?:` + strings.Join(schemes, "|") + `)$`
+			if _, err := regexp.Compile(hrefRe); err != nil {
+				return nil, errors.New("oembed: invalid schemes of " + entry.ProviderName)
+			}
+
+			apiUrl := endpointUrl(endpoint.Url)
+			providers = append(providers, NewOEmbedProvider(hrefRe, apiUrl, cli, san))
+		}
+	}
+
+	return providers, nil
+}
@@ -4,20 +4,32 @@ import (
 	"net/http"
 )
 
-func newSoundCloud(cli *http.Client) EmbeddableProvider {
+func newSoundCloud(cli *http.Client, san *HtmlSanitizer) EmbeddableProvider {
 	const hrefRe = `(?i)(?:https?://)?(?:www\.)?soundcloud\.com/.+`
 	const apiUrl = "https://soundcloud.com/oembed?format=json&show_comments=false&url="
-	return NewOEmbedProvider(hrefRe, apiUrl, cli)
+	return NewOEmbedProvider(hrefRe, apiUrl, cli, san)
 }
 
-func newTickCounter(cli *http.Client) EmbeddableProvider {
+func newTickCounter(cli *http.Client, san *HtmlSanitizer) EmbeddableProvider {
 	const hrefRe = `(?i)(?:https?://)?(?:www\.)?tickcounter\.com/(?:countdown|countup|ticker|worldclock|)/.+`
 	const apiUrl = "https://www.tickcounter.com/oembed?format=json&url="
-	return NewOEmbedProvider(hrefRe, apiUrl, cli)
+	return NewOEmbedProvider(hrefRe, apiUrl, cli, san)
 }
 
-func newVimeo(cli *http.Client) EmbeddableProvider {
+func newVimeo(cli *http.Client, san *HtmlSanitizer) EmbeddableProvider {
 	const hrefRe = `(?i)(?:https?://)?(?:www\.)?vimeo\.com/.+`
 	const apiUrl = "https://vimeo.com/api/oembed.json?url="
-	return NewOEmbedProvider(hrefRe, apiUrl, cli)
+	return NewOEmbedProvider(hrefRe, apiUrl, cli, san)
+}
+
+func newRutube(cli *http.Client, san *HtmlSanitizer) EmbeddableProvider {
+	const hrefRe = `(?i)(?:https?://)?(?:www\.)?rutube\.ru/(?:video|shorts)/[a-f0-9]{32}.*`
+	const apiUrl = "https://rutube.ru/api/oembed/?format=json&url="
+	return NewOEmbedProvider(hrefRe, apiUrl, cli, san)
+}
+
+func newCoub(cli *http.Client, san *HtmlSanitizer) EmbeddableProvider {
+	const hrefRe = `(?i)(?:https?://)?(?:www\.)?coub\.com/view/[a-z0-9]+.*`
+	const apiUrl = "https://coub.com/api/oembed.json?url="
+	return NewOEmbedProvider(hrefRe, apiUrl, cli, san)
 }
@@ -0,0 +1,206 @@
+package embedder
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fixtureTransport serves the responses of the providers from testdata, so tests do not use the network.
+type fixtureTransport map[string]string
+
+func (ft fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for prefix, name := range ft {
+		if !strings.HasPrefix(req.URL.Host+req.URL.Path, prefix) {
+			continue
+		}
+
+		file, err := os.Open(filepath.Join("testdata", name))
+		if err != nil {
+			return nil, err
+		}
+
+		contentType := "text/html; charset=utf-8"
+		if strings.HasSuffix(name, ".json") {
+			contentType = "application/json"
+		}
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {contentType}},
+			Body:       file,
+			Request:    req,
+		}, nil
+	}
+
+	return nil, errors.New("no fixture for " + req.URL.String())
+}
+
+func fixtureClient(fixtures map[string]string) *http.Client {
+	return &http.Client{Transport: fixtureTransport(fixtures)}
+}
+
+func TestProviderPatterns(t *testing.T) {
+	cli := fixtureClient(nil)
+	san := NewHtmlSanitizer(nil)
+
+	patterns := map[string]*regexp.Regexp{
+		"telegram": newTelegram(san).hrefRe,
+		"vk":       newVkVideo(cli, san).hrefRe,
+		"bandcamp": newBandcamp(cli, san).hrefRe,
+		"rutube":   newRutube(cli, san).(*OEmbedProvider).hrefRe,
+		"coub":     newCoub(cli, san).(*OEmbedProvider).hrefRe,
+	}
+
+	tests := []struct {
+		provider string
+		href     string
+		match    bool
+	}{
+		{"telegram", "https://t.me/durov/123", true},
+		{"telegram", "https://t.me/s/durov/123", true},
+		{"telegram", "t.me/mindwell_chat/42?single", true},
+		{"telegram", "https://telegram.me/durov/123/", true},
+		{"telegram", "https://t.me/durov", false},
+		{"telegram", "https://t.me/joinchat/AAAAAE", false},
+		{"telegram", "https://t.me/abc/1", false},
+		{"telegram", "https://t.me.evil.com/durov/123", false},
+
+		{"vk", "https://vk.com/video-12345_456239017", true},
+		{"vk", "https://vkvideo.ru/video-12345_456239017", true},
+		{"vk", "https://m.vk.com/video12345_456239017", true},
+		{"vk", "https://vk.com/wall-1_2?z=video-12345_456239017%2Fpl_wall", true},
+		{"vk", "https://vk.ru/video12345_456239017", true},
+		{"vk", "https://vk.com/durov", false},
+		{"vk", "https://vk.com.evil.com/video1_2", false},
+
+		{"bandcamp", "https://someband.bandcamp.com/album/northern-lights", true},
+		{"bandcamp", "https://someband.bandcamp.com/track/first-song/", true},
+		{"bandcamp", "someband.bandcamp.com/album/northern-lights?from=search", true},
+		{"bandcamp", "https://someband.bandcamp.com/", false},
+		{"bandcamp", "https://bandcamp.com/discover", false},
+		{"bandcamp", "https://someband.bandcamp.com.evil.com/album/x", false},
+
+		{"rutube", "https://rutube.ru/video/0123456789abcdef0123456789abcdef/", true},
+		{"rutube", "https://rutube.ru/shorts/0123456789abcdef0123456789abcdef/", true},
+		{"rutube", "rutube.ru/video/0123456789abcdef0123456789abcdef/?t=10", true},
+		{"rutube", "https://rutube.ru/channel/123456/", false},
+		{"rutube", "https://rutube.ru/video/short/", false},
+
+		{"coub", "https://coub.com/view/2abcde", true},
+		{"coub", "coub.com/view/2abcde?ref=x", true},
+		{"coub", "https://coub.com/community/animals", false},
+	}
+
+	for _, tt := range tests {
+		if got := patterns[tt.provider].MatchString(tt.href); got != tt.match {
+			t.Errorf("%s: %s matched %v, want %v", tt.provider, tt.href, got, tt.match)
+		}
+	}
+}
+
+func TestTelegram(t *testing.T) {
+	emb, err := newTelegram(NewHtmlSanitizer(nil)).Load("https://t.me/s/durov/123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkIframe(t, emb.Embed(), "https://t.me/durov/123?embed=1")
+
+	oe := emb.(*OEmbed)
+	if oe.Url != "https://t.me/durov/123" {
+		t.Errorf("got url %s", oe.Url)
+	}
+}
+
+func TestVkVideo(t *testing.T) {
+	cli := fixtureClient(map[string]string{"vkvideo.ru/video-12345_456239017": "vk_video.html"})
+	emb, err := newVkVideo(cli, NewHtmlSanitizer(nil)).Load("https://vk.com/video-12345_456239017")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkIframe(t, emb.Embed(), "https://vk.com/video_ext.php?oid=-12345&amp;id=456239017&amp;hd=2")
+
+	oe := emb.(*OEmbed)
+	if oe.Title != "Закат над Невой" {
+		t.Errorf("got title %q", oe.Title)
+	}
+	if oe.ThumbnailUrl != "https://sun9-1.userapi.com/impg/preview.jpg?size=800x450" {
+		t.Errorf("got thumbnail %q", oe.ThumbnailUrl)
+	}
+}
+
+func TestVkVideoWithoutMeta(t *testing.T) {
+	emb, err := newVkVideo(fixtureClient(nil), NewHtmlSanitizer(nil)).Load("https://vk.com/video1_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkIframe(t, emb.Embed(), "https://vk.com/video_ext.php?oid=1&amp;id=2&amp;hd=2")
+}
+
+func TestBandcamp(t *testing.T) {
+	cli := fixtureClient(map[string]string{
+		"someband.bandcamp.com/album/northern-lights": "bandcamp_album.html",
+		"someband.bandcamp.com/album/evil":            "bandcamp_evil.html",
+	})
+	bp := newBandcamp(cli, NewHtmlSanitizer(nil))
+
+	emb, err := bp.Load("someband.bandcamp.com/album/northern-lights")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkIframe(t, emb.Embed(), "https://bandcamp.com/EmbeddedPlayer/v=2/album=1234567890/size=large/tracklist=false/artwork=small/")
+
+	oe := emb.(*OEmbed)
+	if oe.Title != "Northern Lights, by Some Band" {
+		t.Errorf("got title %q", oe.Title)
+	}
+
+	_, err = bp.Load("https://someband.bandcamp.com/album/evil")
+	if !errors.Is(err, errorNoMatch) {
+		t.Errorf("the player from other domain is accepted: %v", err)
+	}
+}
+
+func TestOEmbedFixtures(t *testing.T) {
+	cli := fixtureClient(map[string]string{
+		"rutube.ru/api/oembed":     "rutube_oembed.json",
+		"coub.com/api/oembed.json": "coub_oembed.json",
+	})
+	san := NewHtmlSanitizer(nil)
+
+	tests := []struct {
+		name     string
+		provider EmbeddableProvider
+		href     string
+		src      string
+		title    string
+	}{
+		{"rutube", newRutube(cli, san), "https://rutube.ru/video/0123456789abcdef0123456789abcdef/",
+			"https://rutube.ru/play/embed/0123456789abcdef0123456789abcdef", "Как приготовить хлеб дома"},
+		{"coub", newCoub(cli, san), "https://coub.com/view/2abcde",
+			"https://coub.com/embed/2abcde", "Cat vs cucumber"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emb, err := tt.provider.Load(tt.href)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkIframe(t, emb.Embed(), tt.src)
+
+			if oe := emb.(*OEmbed); oe.Title != tt.title {
+				t.Errorf("got title %q", oe.Title)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package embedder
+
+import (
+	"golang.org/x/net/html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// defaultIframeDomains are used by the built-in providers.
+var defaultIframeDomains = []string{
+	"youtube.com",
+	"youtube-nocookie.com",
+	"soundcloud.com",
+	"vimeo.com",
+	"tickcounter.com",
+	"music.yandex.ru",
+	"rutube.ru",
+	"coub.com",
+	"vk.com",
+	"bandcamp.com",
+	"t.me",
+}
+
+// allowedTags are kept by the sanitizer. Other tags are removed, but their text is kept.
+var allowedTags = map[string]bool{
+	"iframe":     true,
+	"blockquote": true,
+	"p":          true,
+	"div":        true,
+	"span":       true,
+	"br":         true,
+	"a":          true,
+	"b":          true,
+	"i":          true,
+	"em":         true,
+	"strong":     true,
+}
+
+// droppedTags are removed with their content.
+var droppedTags = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+	"object":   true,
+	"svg":      true,
+	"math":     true,
+}
+
+var sizeRe = regexp.MustCompile(`^\d{1,4}(?:%|px)?$`)
+
+const (
+	iframeSandbox        = "allow-scripts allow-same-origin allow-popups allow-presentation"
+	iframeReferrerPolicy = "strict-origin-when-cross-origin"
+)
+
+// HtmlSanitizer cleans up the html received from oEmbed providers.
+type HtmlSanitizer struct {
+	domains []string
+}
+
+func NewHtmlSanitizer(domains []string) *HtmlSanitizer {
+	hs := &HtmlSanitizer{}
+
+	for _, domain := range append(defaultIframeDomains, domains...) {
+		domain = strings.ToLower(strings.Trim(domain, ". "))
+		if domain != "" {
+			hs.domains = append(hs.domains, domain)
+		}
+	}
+
+	return hs
+}
+
+func (hs *HtmlSanitizer) isAllowedSrc(src string) bool {
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "") {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range hs.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isHttpUrl(href string) bool {
+	u, err := url.Parse(href)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+func writeAttr(b *strings.Builder, key, value string) {
+	b.WriteByte(' ')
+	b.WriteString(key)
+	b.WriteString(`="`)
+	b.WriteString(html.EscapeString(value))
+	b.WriteByte('"')
+}
+
+func (hs *HtmlSanitizer) writeIframe(b *strings.Builder, attrs []html.Attribute) bool {
+	var src string
+	for _, attr := range attrs {
+		if attr.Key == "src" {
+			src = attr.Val
+		}
+	}
+
+	if !hs.isAllowedSrc(src) {
+		return false
+	}
+
+	b.WriteString("<iframe")
+	writeAttr(b, "src", src)
+
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "width", "height":
+			if sizeRe.MatchString(attr.Val) {
+				writeAttr(b, attr.Key, attr.Val)
+			}
+		case "title", "allow", "frameborder":
+			writeAttr(b, attr.Key, attr.Val)
+		case "allowfullscreen":
+			b.WriteString(" allowfullscreen")
+		}
+	}
+
+	writeAttr(b, "sandbox", iframeSandbox)
+	writeAttr(b, "loading", "lazy")
+	writeAttr(b, "referrerpolicy", iframeReferrerPolicy)
+	b.WriteByte('>')
+
+	return true
+}
+
+func writeLink(b *strings.Builder, attrs []html.Attribute) {
+	b.WriteString("<a")
+
+	for _, attr := range attrs {
+		if attr.Key == "href" && isHttpUrl(attr.Val) {
+			writeAttr(b, "href", attr.Val)
+		}
+	}
+
+	writeAttr(b, "target", "_blank")
+	writeAttr(b, "rel", "noopener noreferrer nofollow")
+	b.WriteByte('>')
+}
+
+// openTags tracks the elements written by the sanitizer, so the result is balanced
+// and the provider html can not close the markup it is inserted into.
+type openTags []string
+
+func (ot *openTags) push(tag string) {
+	*ot = append(*ot, tag)
+}
+
+// close writes the end tags up to the matching open element.
+// The end tag is dropped if there is no such element.
+func (ot *openTags) close(b *strings.Builder, tag string) {
+	for i := len(*ot) - 1; i >= 0; i-- {
+		if (*ot)[i] != tag {
+			continue
+		}
+
+		for j := len(*ot) - 1; j >= i; j-- {
+			b.WriteString("</" + (*ot)[j] + ">")
+		}
+
+		*ot = (*ot)[:i]
+		return
+	}
+}
+
+func (ot *openTags) closeAll(b *strings.Builder) {
+	for i := len(*ot) - 1; i >= 0; i-- {
+		b.WriteString("</" + (*ot)[i] + ">")
+	}
+
+	*ot = nil
+}
+
+// Sanitize keeps iframes from the allowed domains with a fixed set of attributes
+// and simple text markup. Scripts, styles and event handlers are removed.
+func (hs *HtmlSanitizer) Sanitize(content string) string {
+	var b strings.Builder
+	var skip string
+	var open openTags
+
+	z := html.NewTokenizer(strings.NewReader(content))
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			open.closeAll(&b)
+			return b.String()
+		}
+
+		token := z.Token()
+
+		if skip != "" {
+			if tt == html.EndTagToken && token.Data == skip {
+				skip = ""
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			b.WriteString(html.EscapeString(token.Data))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch {
+			case droppedTags[token.Data]:
+				if tt == html.StartTagToken {
+					skip = token.Data
+				}
+			case token.Data == "iframe":
+				if hs.writeIframe(&b, token.Attr) {
+					if tt == html.SelfClosingTagToken {
+						b.WriteString("</iframe>")
+					} else {
+						open.push("iframe")
+					}
+				} else if tt == html.StartTagToken {
+					skip = "iframe"
+				}
+			case token.Data == "br":
+				b.WriteString("<br>")
+			case allowedTags[token.Data]:
+				if token.Data == "a" {
+					writeLink(&b, token.Attr)
+				} else {
+					b.WriteString("<" + token.Data + ">")
+				}
+
+				if tt == html.SelfClosingTagToken {
+					b.WriteString("</" + token.Data + ">")
+				} else {
+					open.push(token.Data)
+				}
+			}
+		case html.EndTagToken:
+			if allowedTags[token.Data] && token.Data != "br" {
+				open.close(&b, token.Data)
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package embedder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// checkIframe checks that the embed is the sandboxed iframe with the source and without scripts.
+func checkIframe(t *testing.T, out, src string) {
+	t.Helper()
+
+	if !strings.Contains(out, `src="`+src+`"`) {
+		t.Errorf("iframe src %s not found in %s", src, out)
+	}
+
+	for _, attr := range []string{`sandbox="` + iframeSandbox + `"`, `loading="lazy"`, `referrerpolicy="` + iframeReferrerPolicy + `"`} {
+		if !strings.Contains(out, attr) {
+			t.Errorf("%s not found in %s", attr, out)
+		}
+	}
+
+	if strings.Contains(strings.ToLower(out), "<script") || strings.Contains(out, "onload=") {
+		t.Errorf("scripts are not removed from %s", out)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	san := NewHtmlSanitizer([]string{"player.example.com"})
+
+	const iframeAttrs = ` sandbox="` + iframeSandbox + `" loading="lazy" referrerpolicy="` + iframeReferrerPolicy + `"`
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "script",
+			in:   `<p>text<script>alert(1)</script></p>`,
+			want: `<p>text</p>`,
+		},
+		{
+			name: "event handlers",
+			in:   `<div onclick="alert(1)"><span onmouseover="alert(2)">text</span></div>`,
+			want: `<div><span>text</span></div>`,
+		},
+		{
+			name: "javascript link",
+			in:   `<a href="javascript:alert(1)">link</a>`,
+			want: `<a target="_blank" rel="noopener noreferrer nofollow">link</a>`,
+		},
+		{
+			name: "http link",
+			in:   `<a href="https://example.com/" onclick="alert(1)">link</a>`,
+			want: `<a href="https://example.com/" target="_blank" rel="noopener noreferrer nofollow">link</a>`,
+		},
+		{
+			name: "unmatched end tags",
+			in:   `</div></div><p>text</p></span>`,
+			want: `<p>text</p>`,
+		},
+		{
+			name: "unclosed tags",
+			in:   `<div><blockquote><p>text`,
+			want: `<div><blockquote><p>text</p></blockquote></div>`,
+		},
+		{
+			name: "misnested tags",
+			in:   `<div><b>text</div></b>`,
+			want: `<div><b>text</b></div>`,
+		},
+		{
+			name: "self-closing tags",
+			in:   `<div/><br/>text`,
+			want: `<div></div><br>text`,
+		},
+		{
+			name: "allowed iframe",
+			in:   `<iframe src="https://player.example.com/v/1" width="640" height="360" onload="alert(1)" style="position:fixed"></iframe>`,
+			want: `<iframe src="https://player.example.com/v/1" width="640" height="360"` + iframeAttrs + `></iframe>`,
+		},
+		{
+			name: "unclosed iframe",
+			in:   `<iframe src="https://www.youtube.com/embed/1">`,
+			want: `<iframe src="https://www.youtube.com/embed/1"` + iframeAttrs + `></iframe>`,
+		},
+		{
+			name: "iframe from other domain",
+			in:   `<iframe src="https://evil.com/player"><p>fallback</p></iframe><p>text</p>`,
+			want: `<p>text</p>`,
+		},
+		{
+			name: "iframe with similar domain",
+			in:   `<iframe src="https://player.example.com.evil.com/"></iframe>`,
+			want: ``,
+		},
+		{
+			name: "javascript iframe",
+			in:   `<iframe src="javascript:alert(1)"></iframe>`,
+			want: ``,
+		},
+		{
+			name: "http iframe",
+			in:   `<iframe src="http://player.example.com/v/1"></iframe>`,
+			want: ``,
+		},
+		{
+			name: "iframe size",
+			in:   `<iframe src="https://player.example.com/v/1" width="100%" height="expression(alert(1))"></iframe>`,
+			want: `<iframe src="https://player.example.com/v/1" width="100%"` + iframeAttrs + `></iframe>`,
+		},
+		{
+			name: "unknown tags",
+			in:   `<form action="/logout"><input value="x"><p>text</p></form>`,
+			want: `<p>text</p>`,
+		},
+		{
+			name: "escaped text",
+			in:   `&lt;script&gt;alert(1)&lt;/script&gt;`,
+			want: `&lt;script&gt;alert(1)&lt;/script&gt;`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := san.Sanitize(tt.in); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadCheckedChecksUrls(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":          "video",
+			"html":          `<iframe src="https://player.example.com/v/1"></iframe>`,
+			"title":         "video",
+			"url":           "javascript:alert(document.cookie)",
+			"thumbnail_url": "data:image/svg+xml,<svg onload=alert(1)>",
+			"provider_name": "Example",
+		})
+	}))
+	defer srv.Close()
+
+	san := NewHtmlSanitizer([]string{"player.example.com"})
+	oep := NewOEmbedProvider(`^https://example\.com/`, srv.URL+"/oembed?url=", srv.Client(), san)
+
+	const href = "https://example.com/video/1"
+	oe, err := oep.LoadChecked(href)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if oe.Url != href {
+		t.Errorf("got url %s, want %s", oe.Url, href)
+	}
+
+	for _, out := range []string{oe.PreviewVideo(), oe.PreviewRich(), oe.Placeholder()} {
+		if strings.Contains(out, "javascript:") || strings.Contains(out, "data:") {
+			t.Errorf("unsafe url in %s", out)
+		}
+		if !strings.Contains(out, `href="`+href+`"`) {
+			t.Errorf("the posted link is not found in %s", out)
+		}
+	}
+}
+
+func TestLoadCheckedSanitizesPayload(t *testing.T) {
+	payloads := map[string]string{
+		"script":  `<div>video</div><script src="https://evil.com/x.js"></script><img src=x onerror="alert(1)">`,
+		"onload":  `<iframe src="https://player.example.com/v/1" onload="alert(document.cookie)"></iframe>`,
+		"link":    `<blockquote><a href="javascript:fetch('/me')">click</a></blockquote>`,
+		"wrapper": `</div></div></div><div class="post"><b>fake</b>`,
+		"iframe":  `<iframe src="https://evil.com/"></iframe><iframe src="data:text/html,<script>alert(1)</script>"></iframe>`,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		link := r.URL.Query().Get("url")
+		name := link[strings.LastIndex(link, "/")+1:]
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":          "rich",
+			"html":          payloads[name],
+			"title":         "<b>title</b>",
+			"provider_name": `Evil"><script>alert(1)</script>`,
+		})
+	}))
+	defer srv.Close()
+
+	san := NewHtmlSanitizer([]string{"player.example.com"})
+	oep := NewOEmbedProvider(`^https://example\.com/`, srv.URL+"/oembed?url=", srv.Client(), san)
+
+	for name := range payloads {
+		t.Run(name, func(t *testing.T) {
+			oe, err := oep.LoadChecked("https://example.com/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, out := range []string{oe.Embed(), oe.Preview(), oe.Placeholder()} {
+				lower := strings.ToLower(out)
+				for _, bad := range []string{"<script", "onload=", "onerror=", "javascript:", "evil.com", "data:text"} {
+					if strings.Contains(lower, bad) {
+						t.Errorf("%q is not removed from %s", bad, out)
+					}
+				}
+			}
+
+			if depth := strings.Count(oe.Embed(), "<div") - strings.Count(oe.Embed(), "</div>"); depth != 0 {
+				t.Errorf("unbalanced html: %s", oe.Embed())
+			}
+		})
+	}
+}
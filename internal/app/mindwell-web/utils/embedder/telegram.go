@@ -0,0 +1,44 @@
+package embedder
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type tgProvider struct {
+	hrefRe *regexp.Regexp
+	san    *HtmlSanitizer
+}
+
+func newTelegram(san *HtmlSanitizer) *tgProvider {
+	return &tgProvider{
+		hrefRe: regexp.MustCompile(`^(?i)(?:https?://)?(?:t\.me|telegram\.me)/(?:s/)?([a-z]\w{3,31})/(\d+)/?(?:[?#].*)?$`),
+		san:    san,
+	}
+}
+
+func (tp *tgProvider) Load(href string) (Embeddable, error) {
+	match := tp.hrefRe.FindStringSubmatch(href)
+	if len(match) == 0 {
+		return nil, errorNoMatch
+	}
+
+	channel, post := match[1], match[2]
+
+	// the post is rendered by Telegram in the sandbox instead of their widget script
+	const template = `<iframe src="https://t.me/%s/%s?embed=1" width="100%%" height="400" frameborder="0"></iframe>`
+
+	oe := &OEmbed{
+		Title:        "Пост в Телеграме",
+		Description:  "@" + channel,
+		ProviderName: "Telegram",
+		Type:         "rich",
+		Url:          "https://t.me/" + channel + "/" + post,
+		CacheAge:     30 * 24 * 60 * 60,
+		ID:           channel + "-" + post,
+	}
+
+	oe.Html = embedHtml(tp.san, fmt.Sprintf(template, channel, post), oe.ProviderName, oe.ID)
+
+	return oe, nil
+}
@@ -0,0 +1,59 @@
+package embedder
+
+import (
+	"fmt"
+	"github.com/sevings/mindwell-server/utils"
+	"net/http"
+	"regexp"
+)
+
+type vkVideoProvider struct {
+	hrefRe *regexp.Regexp
+	cli    *http.Client
+	san    *HtmlSanitizer
+}
+
+func newVkVideo(cli *http.Client, san *HtmlSanitizer) *vkVideoProvider {
+	const hrefRe = `^(?i)(?:https?://)?(?:www\.|m\.)?(?:vk\.com|vk\.ru|vkvideo\.ru)/(?:[^?#]*[?&]z=)?video(-?\d+)_(\d+)`
+
+	return &vkVideoProvider{
+		hrefRe: regexp.MustCompile(hrefRe),
+		cli:    cli,
+		san:    san,
+	}
+}
+
+func (vp *vkVideoProvider) Load(href string) (Embeddable, error) {
+	match := vp.hrefRe.FindStringSubmatch(href)
+	if len(match) == 0 {
+		return nil, errorNoMatch
+	}
+
+	owner, id := match[1], match[2]
+
+	const template = `<iframe width="640" height="360" frameborder="0" src="https://vk.com/video_ext.php?oid=%s&amp;id=%s&amp;hd=2"
+	allow="autoplay; encrypted-media; fullscreen; picture-in-picture" allowfullscreen></iframe>`
+
+	oe := &OEmbed{
+		Title:        "Видео ВКонтакте",
+		ProviderName: "VK Видео",
+		Type:         "video",
+		Url:          "https://vkvideo.ru/video" + owner + "_" + id,
+		CacheAge:     7 * 24 * 60 * 60,
+		ID:           owner + "_" + id,
+	}
+
+	oe.Html = embedHtml(vp.san, fmt.Sprintf(template, owner, id), "VK", oe.ID)
+
+	// the player works without the page metadata, so it is optional
+	meta, base, err := loadHtmlMeta(vp.cli, oe.Url)
+	if err == nil {
+		if title := meta.first("og:title", "title"); title != "" {
+			oe.Title, _ = utils.CutText(title, 100)
+		}
+		oe.Description, _ = utils.CutText(meta.first("og:description"), 200)
+		oe.ThumbnailUrl = secureUrl(base, meta.first("og:image"))
+	}
+
+	return oe, nil
+}
@@ -2,26 +2,47 @@ package embedder
 
 import (
 	"fmt"
+	"html"
 	"regexp"
 	"time"
 )
 
+// yamIframeUrl is the widget page, which reads the embedded object from the fragment.
+const yamIframeUrl = "https://music.yandex.ru/iframe/#"
+
 type yamEmbed struct {
-	tag string
+	href string
+	kind string
+	html string
 }
 
-func newYamEmbed(href string) *yamEmbed {
-	return &yamEmbed{
-		tag: fmt.Sprintf(`<a href="%s" target="_blank">Яндекс Музыка</a>`, href),
-	}
+func (yam yamEmbed) Embed() string {
+	return yam.html
 }
 
-func (yam yamEmbed) Embed() string {
-	return yam.tag
+func (yam yamEmbed) card(content string) string {
+	const template = `
+<div class="post-video">
+	<div class="video-content">
+		<span class="h4 title">%s</span>
+		%s
+		<a href="%s" class="link-site" target="_blank">Яндекс Музыка</a>
+	</div>
+</div>
+`
+
+	return fmt.Sprintf(template, yam.kind, content, html.EscapeString(yam.href))
 }
 
 func (yam yamEmbed) Preview() string {
-	return yam.tag
+	return yam.card("")
+}
+
+func (yam yamEmbed) Placeholder() string {
+	const content = `<button type="button" class="btn btn-sm btn-primary load-embed">Загрузить контент с сайта Яндекс Музыка</button>
+		<template>%s</template>`
+
+	return `<div class="embed-placeholder">` + yam.card(fmt.Sprintf(content, yam.Embed())) + `</div>`
 }
 
 func (yam yamEmbed) CacheControl() time.Duration {
@@ -29,20 +50,54 @@ func (yam yamEmbed) CacheControl() time.Duration {
 }
 
 type yamProvider struct {
-	hrefRe *regexp.Regexp
+	san        *HtmlSanitizer
+	trackRe    *regexp.Regexp
+	albumRe    *regexp.Regexp
+	playlistRe *regexp.Regexp
+	artistRe   *regexp.Regexp
 }
 
-func newYandexMusic() *yamProvider {
+func newYandexMusic(san *HtmlSanitizer) *yamProvider {
+	const domain = `^(?i)(?:https?://)?music\.yandex\.(?:ru|com|kz|ua|by)/`
+	const tail = `/?(?:[?#].*)?$`
+
 	return &yamProvider{
-		hrefRe: regexp.MustCompile(`^(?i)(?:https://)?music.yandex.(?:ru|com|kz|ua)/`),
+		san:        san,
+		trackRe:    regexp.MustCompile(domain + `album/(\d+)/track/(\d+)` + tail),
+		albumRe:    regexp.MustCompile(domain + `album/(\d+)` + tail),
+		playlistRe: regexp.MustCompile(domain + `users/([\w.\-]+)/playlists/(\d+)` + tail),
+		artistRe:   regexp.MustCompile(domain + `artist/(\d+)` + tail),
+	}
+}
+
+func (mp *yamProvider) embed(href, kind, id string, height int) *yamEmbed {
+	const template = `<iframe frameborder="0" allow="clipboard-write" width="100%%" height="%d" src="%s"></iframe>`
+
+	content := fmt.Sprintf(template, height, yamIframeUrl+id)
+
+	return &yamEmbed{
+		href: href,
+		kind: kind,
+		html: embedHtml(mp.san, content, "YandexMusic", id),
 	}
 }
 
 func (mp *yamProvider) Load(href string) (Embeddable, error) {
-	match := mp.hrefRe.FindStringSubmatch(href)
-	if len(match) == 0 {
-		return nil, errorNoMatch
+	if match := mp.trackRe.FindStringSubmatch(href); len(match) > 0 {
+		return mp.embed(href, "Трек", "track/"+match[2]+"/"+match[1], 180), nil
+	}
+
+	if match := mp.albumRe.FindStringSubmatch(href); len(match) > 0 {
+		return mp.embed(href, "Альбом", "album/"+match[1], 450), nil
+	}
+
+	if match := mp.playlistRe.FindStringSubmatch(href); len(match) > 0 {
+		return mp.embed(href, "Плейлист", "playlist/"+match[1]+"/"+match[2], 450), nil
+	}
+
+	if match := mp.artistRe.FindStringSubmatch(href); len(match) > 0 {
+		return mp.embed(href, "Исполнитель", "artist/"+match[1], 450), nil
 	}
 
-	return newYamEmbed(href), nil
+	return nil, errorNoMatch
 }
@@ -0,0 +1,67 @@
+package embedder
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestYandexMusic(t *testing.T) {
+	mp := newYandexMusic(NewHtmlSanitizer(nil))
+
+	tests := []struct {
+		path string
+		kind string
+		src  string
+	}{
+		{"album/123/track/456", "Трек", "https://music.yandex.ru/iframe/#track/456/123"},
+		{"album/123/track/456/", "Трек", "https://music.yandex.ru/iframe/#track/456/123"},
+		{"album/123/track/456?utm_source=web", "Трек", "https://music.yandex.ru/iframe/#track/456/123"},
+		{"album/123", "Альбом", "https://music.yandex.ru/iframe/#album/123"},
+		{"album/123#tracks", "Альбом", "https://music.yandex.ru/iframe/#album/123"},
+		{"users/music.user-1/playlists/1003", "Плейлист", "https://music.yandex.ru/iframe/#playlist/music.user-1/1003"},
+		{"artist/789", "Исполнитель", "https://music.yandex.ru/iframe/#artist/789"},
+		{"artist/789/", "Исполнитель", "https://music.yandex.ru/iframe/#artist/789"},
+		{"artist/789/tracks", "", ""},
+		{"album/abc", "", ""},
+		{"users/name/playlists", "", ""},
+		{"", "", ""},
+	}
+
+	for _, domain := range []string{"ru", "com", "kz", "ua", "by"} {
+		for _, prefix := range []string{"https://", "http://", ""} {
+			for _, tt := range tests {
+				href := prefix + "music.yandex." + domain + "/" + tt.path
+
+				emb, err := mp.Load(href)
+				if tt.kind == "" {
+					if !errors.Is(err, errorNoMatch) {
+						t.Errorf("%s: expected no match, got %v", href, err)
+					}
+					continue
+				}
+
+				if err != nil {
+					t.Errorf("%s: %v", href, err)
+					continue
+				}
+
+				yam := emb.(*yamEmbed)
+				if yam.kind != tt.kind {
+					t.Errorf("%s: got kind %s, want %s", href, yam.kind, tt.kind)
+				}
+
+				checkIframe(t, emb.Embed(), tt.src)
+			}
+		}
+	}
+
+	for _, href := range []string{
+		"https://music.yandex.de/album/123",
+		"https://music.yandex.ru.evil.com/album/123",
+		"https://evil.com/music.yandex.ru/album/123",
+	} {
+		if _, err := mp.Load(href); !errors.Is(err, errorNoMatch) {
+			t.Errorf("%s: expected no match, got %v", href, err)
+		}
+	}
+}
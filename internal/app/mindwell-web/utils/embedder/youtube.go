@@ -6,11 +6,21 @@ import (
 	"regexp"
 )
 
+// ytEmbed loads the video from youtube-nocookie.com when it is shown on click.
+type ytEmbed struct {
+	*OEmbed
+	nocookie string
+}
+
+func (yt *ytEmbed) Placeholder() string {
+	return yt.placeholder(yt.nocookie)
+}
+
 type ytProvider struct {
 	OEmbedProvider
 }
 
-func newYouTube(cli *http.Client) EmbeddableProvider {
+func newYouTube(cli *http.Client, san *HtmlSanitizer) EmbeddableProvider {
 	const hrefRe = `(?i)(?:https?://)?(?:www\.)?(?:m\.)?(?:youtube.com/watch\?.*v=|youtu.be/|youtube.com/shorts/)([a-z0-9\-_]+).*`
 	const apiUrl = "https://www.youtube.com/oembed?url="
 
@@ -19,6 +29,7 @@ func newYouTube(cli *http.Client) EmbeddableProvider {
 			hrefRe: regexp.MustCompile(hrefRe),
 			apiUrl: apiUrl,
 			cli:    cli,
+			san:    san,
 		},
 	}
 }
@@ -36,10 +47,12 @@ func (ytp *ytProvider) Load(href string) (Embeddable, error) {
 		return nil, err
 	}
 
-	const template = `<iframe class="embed" data-provider="YouTube" data-embed="%s" type="text/html" frameborder="0" width="480" height="270" 
-	src="https://www.youtube.com/embed/%s?enablejsapi=1" allowfullscreen></iframe>`
-	oe.Html = fmt.Sprintf(template, id, id)
+	const template = `<iframe frameborder="0" width="480" height="270" src="https://%s/embed/%s?enablejsapi=1" allowfullscreen></iframe>`
+	oe.Html = embedHtml(ytp.san, fmt.Sprintf(template, "www.youtube.com", id), "YouTube", id)
 	oe.ID = id
 
-	return oe, nil
+	return &ytEmbed{
+		OEmbed:   oe,
+		nocookie: embedHtml(ytp.san, fmt.Sprintf(template, "www.youtube-nocookie.com", id), "YouTube", id),
+	}, nil
 }
@@ -0,0 +1,52 @@
+package embedder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestYouTube(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":          "video",
+			"html":          `<iframe src="https://www.youtube.com/embed/dQw4w9WgXcQ?feature=oembed"></iframe>`,
+			"title":         "Never Gonna Give You Up",
+			"thumbnail_url": "https://i.ytimg.com/vi/dQw4w9WgXcQ/hqdefault.jpg",
+			"provider_name": "YouTube",
+		})
+	}))
+	defer srv.Close()
+
+	ytp := newYouTube(srv.Client(), NewHtmlSanitizer(nil)).(*ytProvider)
+	ytp.apiUrl = srv.URL + "/oembed?url="
+
+	for _, href := range []string{
+		"https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+		"https://youtu.be/dQw4w9WgXcQ",
+		"https://m.youtube.com/shorts/dQw4w9WgXcQ",
+	} {
+		emb, err := ytp.Load(href)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkIframe(t, emb.Embed(), "https://www.youtube.com/embed/dQw4w9WgXcQ?enablejsapi=1")
+
+		placeholder := Placeholder(emb)
+		start := strings.Index(placeholder, "<template>")
+		end := strings.Index(placeholder, "</template>")
+		if start < 0 || end < start {
+			t.Fatalf("template not found in placeholder: %s", placeholder)
+		}
+
+		checkIframe(t, placeholder[start:end], "https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ?enablejsapi=1")
+	}
+
+	if _, err := ytp.Load("https://vimeo.com/123"); err != errorNoMatch {
+		t.Errorf("got error %v for other site", err)
+	}
+}
@@ -0,0 +1,166 @@
+package htmlwalk
+
+import (
+	"golang.org/x/net/html"
+	"strings"
+)
+
+// Rewriter replaces links and images in html content.
+// The content not touched by the callbacks is written as is.
+type Rewriter struct {
+	// Link is called for anchors whose text is their href.
+	// tag is the anchor html including its text and the end tag.
+	Link func(tag, href string) string
+	// Image is called for images with a source.
+	Image func(tag, src string) string
+}
+
+type bufferedToken struct {
+	tt  html.TokenType
+	raw string
+	src string
+}
+
+// Rewrite walks the content once replacing both links and images.
+func (rw Rewriter) Rewrite(content string) string {
+	var b strings.Builder
+	b.Grow(len(content))
+
+	z := html.NewTokenizer(strings.NewReader(content))
+
+	// tokens inside an anchor are held until it is known whether it is a plain link
+	var anchor []bufferedToken
+	var href string
+	var inAnchor bool
+
+	flush := func() {
+		for _, t := range anchor {
+			rw.writeToken(&b, t)
+		}
+		anchor = anchor[:0]
+		inAnchor = false
+	}
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			flush()
+			return b.String()
+		}
+
+		raw := string(z.Raw())
+		name, hasAttr := z.TagName()
+		tagName := string(name)
+
+		var attrs map[string]string
+		if hasAttr {
+			attrs = make(map[string]string)
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(value)
+			}
+		}
+
+		t := bufferedToken{tt: tt, raw: raw}
+		if tagName == "img" && (tt == html.StartTagToken || tt == html.SelfClosingTagToken) {
+			t.src = attrs["src"]
+		}
+
+		switch {
+		case tagName == "a" && tt == html.StartTagToken:
+			flush()
+			anchor = append(anchor, t)
+			href = attrs["href"]
+			inAnchor = href != ""
+			if !inAnchor {
+				flush()
+			}
+		case inAnchor && tagName == "a" && tt == html.EndTagToken:
+			anchor = append(anchor, t)
+			if rw.Link != nil && len(anchor) == 3 && anchor[1].tt == html.TextToken &&
+				IsAutoLink(href, html.UnescapeString(anchor[1].raw)) {
+				b.WriteString(rw.Link(anchor[0].raw+anchor[1].raw+anchor[2].raw, href))
+				anchor = anchor[:0]
+				inAnchor = false
+			} else {
+				flush()
+			}
+		case inAnchor:
+			anchor = append(anchor, t)
+		default:
+			rw.writeToken(&b, t)
+		}
+	}
+}
+
+func (rw Rewriter) writeToken(b *strings.Builder, t bufferedToken) {
+	if t.src != "" && rw.Image != nil {
+		b.WriteString(rw.Image(t.raw, t.src))
+	} else {
+		b.WriteString(t.raw)
+	}
+}
+
+// IsAutoLink reports whether the anchor text is its href, possibly shortened.
+func IsAutoLink(href, text string) bool {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return false
+	}
+
+	if text == href {
+		return true
+	}
+
+	for _, ellipsis := range []string{"…", "..."} {
+		if prefix, ok := strings.CutSuffix(text, ellipsis); ok && len(prefix) >= 20 {
+			return strings.HasPrefix(href, prefix)
+		}
+	}
+
+	return false
+}
+
+// ParseImage returns the source of the image tag and its other attributes.
+func ParseImage(tag string) (src, props string, ok bool) {
+	z := html.NewTokenizer(strings.NewReader(tag))
+
+	tt := z.Next()
+	if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+		return "", "", false
+	}
+
+	name, hasAttr := z.TagName()
+	if string(name) != "img" {
+		return "", "", false
+	}
+
+	var b strings.Builder
+	for hasAttr {
+		var key, value []byte
+		key, value, hasAttr = z.TagAttr()
+		if string(key) == "src" {
+			src = string(value)
+			continue
+		}
+
+		b.WriteByte(' ')
+		b.Write(key)
+		b.WriteString(`="`)
+		b.WriteString(html.EscapeString(string(value)))
+		b.WriteByte('"')
+	}
+
+	return src, b.String(), src != ""
+}
+
+// SetImageSrc rebuilds the image tag with the new source.
+func SetImageSrc(tag, src string) string {
+	_, props, ok := ParseImage(tag)
+	if !ok {
+		return tag
+	}
+
+	return `<img src="` + html.EscapeString(src) + `"` + props + `>`
+}
@@ -0,0 +1,122 @@
+package htmlwalk
+
+import (
+	"testing"
+)
+
+func testRewriter() Rewriter {
+	return Rewriter{
+		Link: func(tag, href string) string {
+			return "[link " + href + "]"
+		},
+		Image: func(tag, src string) string {
+			return "[image " + src + "]"
+		},
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		content string
+		result  string
+	}{
+		{`<p><a href="https://example.com/a">https://example.com/a</a></p>`, `<p>[link https://example.com/a]</p>`},
+		{`<a href='https://example.com/a'>https://example.com/a</a>`, `[link https://example.com/a]`},
+		{`<a rel="nofollow" target="_blank" href="https://example.com/a">https://example.com/a</a>`, `[link https://example.com/a]`},
+		{`<a href="https://example.com/?a=1&amp;b=2">https://example.com/?a=1&amp;b=2</a>`, `[link https://example.com/?a=1&b=2]`},
+		{`<a href="https://example.com/a">title</a>`, `<a href="https://example.com/a">title</a>`},
+		{`<a href="https://example.com/a"><b>https://example.com/a</b></a>`, `<a href="https://example.com/a"><b>https://example.com/a</b></a>`},
+		{`<a name="top">https://example.com/a</a>`, `<a name="top">https://example.com/a</a>`},
+		{`<a href="https://example.com/a">https://example.com/a`, `<a href="https://example.com/a">https://example.com/a`},
+		{`<p><img alt='x' src='https://example.com/i.png'/></p>`, `<p>[image https://example.com/i.png]</p>`},
+		{`<img src="https://example.com/i.png" alt="x">`, `[image https://example.com/i.png]`},
+		{`<img alt="x">`, `<img alt="x">`},
+		{`<a href="https://example.com/a"><img src="https://example.com/i.png"></a>`, `<a href="https://example.com/a">[image https://example.com/i.png]</a>`},
+		{`<blockquote><p>text <a href="https://example.com/a">https://example.com/a</a> <i>and</i> <img src="https://example.com/i.png"></p></blockquote>`,
+			`<blockquote><p>text [link https://example.com/a] <i>and</i> [image https://example.com/i.png]</p></blockquote>`},
+	}
+
+	rw := testRewriter()
+	for _, tt := range tests {
+		if got := rw.Rewrite(tt.content); got != tt.result {
+			t.Errorf("Rewrite(%s) = %s, want %s", tt.content, got, tt.result)
+		}
+	}
+}
+
+func TestRewriteWithoutCallbacks(t *testing.T) {
+	const content = `<p><a href="https://example.com/a">https://example.com/a</a><img src="https://example.com/i.png"></p>`
+
+	if got := (Rewriter{}).Rewrite(content); got != content {
+		t.Errorf("Rewrite(%s) = %s", content, got)
+	}
+}
+
+func TestIsAutoLink(t *testing.T) {
+	tests := []struct {
+		href string
+		text string
+		auto bool
+	}{
+		{"https://example.com/a", "https://example.com/a", true},
+		{"https://example.com/a", " https://example.com/a\n", true},
+		{"https://example.com/a/very/long/path", "https://example.com/a/very…", true},
+		{"https://example.com/a/very/long/path", "https://example.com/a/very...", true},
+		{"https://example.com/a/very/long/path", "https://example…", false},
+		{"https://example.com/a/very/long/path", "https://example.com/b/very…", false},
+		{"https://example.com/a", "example", false},
+		{"https://example.com/a", "", false},
+		{"", "  ", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsAutoLink(tt.href, tt.text); got != tt.auto {
+			t.Errorf("IsAutoLink(%s, %s) = %v, want %v", tt.href, tt.text, got, tt.auto)
+		}
+	}
+}
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		tag   string
+		src   string
+		props string
+		ok    bool
+	}{
+		{`<img src="a.png" alt="x">`, "a.png", ` alt="x"`, true},
+		{`<img alt='x' src='a.png' class=wide>`, "a.png", ` alt="x" class="wide"`, true},
+		{`<img alt="a &amp; b" src="a.png"/>`, "a.png", ` alt="a &amp; b"`, true},
+		{`<img alt="x">`, "", ` alt="x"`, false},
+		{`<p><img src="a.png"></p>`, "", "", false},
+		{`<a href="a.png">`, "", "", false},
+		{`a.png`, "", "", false},
+	}
+
+	for _, tt := range tests {
+		src, props, ok := ParseImage(tt.tag)
+		if src != tt.src || props != tt.props || ok != tt.ok {
+			t.Errorf("ParseImage(%s) = %s, %s, %v, want %s, %s, %v",
+				tt.tag, src, props, ok, tt.src, tt.props, tt.ok)
+		}
+	}
+}
+
+func TestSetImageSrc(t *testing.T) {
+	tests := []struct {
+		tag    string
+		src    string
+		result string
+	}{
+		{`<img src="a.png">`, "b.png", `<img src="b.png">`},
+		{`<img alt='x' src='a.png' width=100 />`, "b.png", `<img src="b.png" alt="x" width="100">`},
+		{`<img src="a.png">`, "b.png?a=1&b=2", `<img src="b.png?a=1&amp;b=2">`},
+		{`<img alt="x">`, "b.png", `<img alt="x">`},
+		{`<p>a.png</p>`, "b.png", `<p>a.png</p>`},
+	}
+
+	for _, tt := range tests {
+		if got := SetImageSrc(tt.tag, tt.src); got != tt.result {
+			t.Errorf("SetImageSrc(%s, %s) = %s, want %s", tt.tag, tt.src, got, tt.result)
+		}
+	}
+}
@@ -2,24 +2,29 @@ package images
 
 import (
 	"fmt"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/mediaproxy"
+	"html"
 	"time"
 )
 
 type baseEmbed struct {
+	proxy *mediaproxy.Proxy
 }
 
-func NewBaseEmbed() ImageProvider {
-	return &baseEmbed{}
+func NewBaseEmbed(proxy *mediaproxy.Proxy) ImageProvider {
+	return &baseEmbed{proxy: proxy}
 }
 
 func (b baseEmbed) Load(href, props string) (*ImageData, error) {
-	data := &ImageData{}
+	data := &ImageData{Url: href}
+
+	src := html.EscapeString(b.proxy.URL(href))
 
 	const a = `<a href="%s" target="__blank" class="js-zoom-image"><img src="%s" %s></a>`
-	data.Embed = fmt.Sprintf(a, href, href, props)
+	data.Embed = fmt.Sprintf(a, src, src, props)
 
 	const img = `<img src="%s" %s>`
-	data.Preview = fmt.Sprintf(img, href, props)
+	data.Preview = fmt.Sprintf(img, src, props)
 
 	data.Exp = 24 * time.Hour
 
@@ -0,0 +1,150 @@
+package images
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+)
+
+const blurhashChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurhashSize is the width of the decoded placeholder. Browsers scale it up smoothly,
+// so the tiny image keeps the page small.
+const blurhashSize = 16
+
+var errorBlurhash = errors.New("invalid blurhash")
+
+func decode83(str string) (int, error) {
+	var value int
+	for _, c := range str {
+		digit := strings.IndexRune(blurhashChars, c)
+		if digit < 0 {
+			return 0, errorBlurhash
+		}
+
+		value = value*83 + digit
+	}
+
+	return value, nil
+}
+
+func srgbToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) uint8 {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return uint8(v*12.92*255 + 0.5)
+	}
+
+	return uint8((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+// decodeBlurhash renders the hash as an image of the given size.
+// See https://github.com/woltapp/blurhash for the format.
+func decodeBlurhash(hash string, width, height int) (image.Image, error) {
+	if len(hash) < 6 {
+		return nil, errorBlurhash
+	}
+
+	sizeFlag, err := decode83(hash[:1])
+	if err != nil {
+		return nil, err
+	}
+
+	numX := sizeFlag%9 + 1
+	numY := sizeFlag/9 + 1
+	if len(hash) != 4+2*numX*numY {
+		return nil, errorBlurhash
+	}
+
+	quantMax, err := decode83(hash[1:2])
+	if err != nil {
+		return nil, err
+	}
+
+	maxValue := float64(quantMax+1) / 166
+
+	colors := make([][3]float64, numX*numY)
+
+	dc, err := decode83(hash[2:6])
+	if err != nil {
+		return nil, err
+	}
+
+	colors[0] = [3]float64{srgbToLinear(dc >> 16), srgbToLinear(dc >> 8 & 255), srgbToLinear(dc & 255)}
+
+	for i := 1; i < len(colors); i++ {
+		ac, err := decode83(hash[4+i*2 : 6+i*2])
+		if err != nil {
+			return nil, err
+		}
+
+		colors[i] = [3]float64{
+			signPow((float64(ac/(19*19))-9)/9, 2) * maxValue,
+			signPow((float64(ac/19%19)-9)/9, 2) * maxValue,
+			signPow((float64(ac%19)-9)/9, 2) * maxValue,
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b float64
+			for j := 0; j < numY; j++ {
+				for i := 0; i < numX; i++ {
+					basis := math.Cos(math.Pi*float64(x*i)/float64(width)) *
+						math.Cos(math.Pi*float64(y*j)/float64(height))
+					c := colors[i+j*numX]
+					r += c[0] * basis
+					g += c[1] * basis
+					b += c[2] * basis
+				}
+			}
+
+			img.SetNRGBA(x, y, color.NRGBA{R: linearToSrgb(r), G: linearToSrgb(g), B: linearToSrgb(b), A: 255})
+		}
+	}
+
+	return img, nil
+}
+
+// blurhashUrl returns the placeholder as a data url of a png image with the aspect ratio of the image.
+func blurhashUrl(hash string, width, height int64) (string, error) {
+	if width <= 0 || height <= 0 {
+		return "", errorBlurhash
+	}
+
+	w, h := blurhashSize, int(blurhashSize*height/width)
+	if h > blurhashSize {
+		w, h = int(blurhashSize*width/height), blurhashSize
+	}
+
+	img, err := decodeBlurhash(hash, max(w, 1), max(h, 1))
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return "", err
+	}
+
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -1,29 +1,129 @@
 package images
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/patrickmn/go-cache"
 	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/cachestore"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/htmlwalk"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/mediaproxy"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/workpool"
 	"go.uber.org/zap"
-	"net/http"
-	"regexp"
+	"sync"
 	"time"
 )
 
 type ImageData struct {
 	Embed   string
 	Preview string
+	Url     string
+	Width   int64
+	Height  int64
 	Exp     time.Duration
-	access  time.Time
-	load    time.Time
 }
 
-func (data *ImageData) isUsed() bool {
-	return data.access.Add(180 * 24 * time.Hour).After(time.Now())
+// Mode returns the image rendered for the layout of the media filter mode.
+// The full content is shown in the entry layout, otherwise in the feed layout.
+func (img *ImageData) Mode(mode string) string {
+	if mode == "embed" || mode == "placeholder" {
+		return img.Embed
+	}
+
+	return img.Preview
+}
+
+// imageEntry is a cached image. The loaded data is never modified,
+// reloads replace it under the mutex.
+type imageEntry struct {
+	mu       sync.RWMutex
+	data     *ImageData
+	provider string
+	access   time.Time
+	load     time.Time
+	purged   bool
+}
+
+func newImageEntry(data *ImageData) *imageEntry {
+	return &imageEntry{
+		data:   data,
+		access: time.Now(),
+	}
+}
+
+// use marks the image as accessed and returns the current data.
+func (entry *imageEntry) use() *ImageData {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	entry.access = time.Now()
+	return entry.data
+}
+
+func (entry *imageEntry) get() (data *ImageData, access, load time.Time) {
+	entry.mu.RLock()
+	defer entry.mu.RUnlock()
+
+	return entry.data, entry.access, entry.load
+}
+
+func (entry *imageEntry) set(data *ImageData, provider string) {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	entry.data = data
+	entry.provider = provider
+	entry.load = time.Now()
+}
+
+func (entry *imageEntry) info(src string, exp time.Time) cachestore.Info {
+	entry.mu.RLock()
+	defer entry.mu.RUnlock()
+
+	return cachestore.Info{
+		Key:      src,
+		Provider: entry.provider,
+		Access:   entry.access,
+		Load:     entry.load,
+		Expires:  exp,
+	}
 }
 
-func (data *ImageData) isExpired() bool {
-	return data.load.Add(data.Exp).Before(time.Now())
+// purge prevents the image from being reloaded when it is evicted.
+func (entry *imageEntry) purge() {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	entry.purged = true
+}
+
+func (entry *imageEntry) isPurged() bool {
+	entry.mu.RLock()
+	defer entry.mu.RUnlock()
+
+	return entry.purged
+}
+
+// keep puts the image to the cache unless it has been purged. The mutex is held,
+// so the purge waits for it and then removes the image.
+func (entry *imageEntry) keep(c *cache.Cache, tag string, exp time.Duration) {
+	entry.mu.RLock()
+	defer entry.mu.RUnlock()
+
+	if !entry.purged {
+		c.Set(tag, entry, exp)
+	}
+}
+
+func (entry *imageEntry) isUsed() bool {
+	_, access, _ := entry.get()
+	return access.Add(180 * 24 * time.Hour).After(time.Now())
+}
+
+func (entry *imageEntry) isExpired() bool {
+	data, _, load := entry.get()
+	return load.Add(data.Exp).Before(time.Now())
 }
 
 func NewImageData(tag string) *ImageData {
@@ -33,92 +133,307 @@ func NewImageData(tag string) *ImageData {
 	}
 }
 
+// newPendingImageData marks the original tag to be replaced when the image is loaded.
+func newPendingImageData(tag string) *ImageData {
+	mark := func(mode string) string {
+		return tag[:4] + ` data-embed-pending="` + mode + `"` + tag[4:]
+	}
+
+	return &ImageData{
+		Embed:   mark("embed"),
+		Preview: mark("preview"),
+	}
+}
+
 type ImageProvider interface {
 	Load(href, props string) (*ImageData, error)
 }
 
 var errorNoMatch = errors.New("could not embed this image")
 
+// retryExp is the lifetime of the images still processed by the server and failed to load,
+// so they are shown as is until the next attempt.
+const retryExp = time.Minute
+
 type ImageEmbedder struct {
-	es     []ImageProvider
-	cache  *cache.Cache
-	imgRe  *regexp.Regexp
-	propRe *regexp.Regexp
-	log    *zap.Logger
+	es    []ImageProvider
+	cache *cache.Cache
+	store cachestore.Backend
+	pool  *workpool.Pool
+	srcs  *cache.Cache
+	stat  cachestore.Counter
+	log   *zap.Logger
 }
 
-func NewImageEmbedder(m *utils.Mindwell, log *zap.Logger) *ImageEmbedder {
+func NewImageEmbedder(m *utils.Mindwell, log *zap.Logger, proxy *mediaproxy.Proxy) *ImageEmbedder {
 	e := &ImageEmbedder{
-		cache:  cache.New(180*24*time.Hour, 24*time.Hour),
-		imgRe:  regexp.MustCompile(`(?i)<img[^>]+>`),
-		propRe: regexp.MustCompile(`(?i)<img([^>]+)src="([^"]+)"([^>]*)>`),
-		log:    log,
+		cache: cache.New(180*24*time.Hour, 24*time.Hour),
+		store: cachestore.NewBackend(m, "images"),
+		pool:  workpool.New(imageWorkers(m), 1024, log),
+		srcs:  cache.New(10*time.Minute, 10*time.Minute),
+		log:   log,
 	}
 
 	e.cache.OnEvicted(func(tag string, cached interface{}) {
-		data := cached.(*ImageData)
+		entry := cached.(*imageEntry)
+		if entry.isPurged() {
+			return
+		}
 
-		if data.access.After(data.load) {
-			e.reload(tag, data)
+		if _, access, load := entry.get(); access.After(load) {
+			e.pool.Submit(tag, func() { e.reload(tag, entry) })
 			return
 		}
 
-		if data.isUsed() {
-			e.cache.SetDefault(tag, data)
+		if entry.isUsed() {
+			entry.keep(e.cache, tag, cache.DefaultExpiration)
 		}
 	})
 
-	cli := &http.Client{Timeout: 2 * time.Second}
+	e.restore()
+
+	cli := m.HttpClient(2 * time.Second)
 
 	e.AddImageProvider(NewMindwellProvider(m, cli))
-	e.AddImageProvider(NewBaseEmbed())
+	e.AddImageProvider(NewBaseEmbed(proxy))
 
 	return e
 }
 
+func imageWorkers(m *utils.Mindwell) int {
+	workers := m.ConfigInt("embed.workers")
+	if workers <= 0 {
+		return 4
+	}
+
+	return workers
+}
+
+func (e *ImageEmbedder) restore() {
+	if e.store == nil {
+		return
+	}
+
+	records, err := e.store.Load()
+	if err != nil {
+		e.log.Error("images", zap.Error(err))
+		return
+	}
+
+	for _, rec := range records {
+		data := &ImageData{}
+		err = json.Unmarshal(rec.Value, data)
+		if err != nil {
+			e.log.Warn("images", zap.Error(err))
+			continue
+		}
+
+		entry := &imageEntry{
+			data:   data,
+			access: rec.Access,
+			load:   rec.Load,
+		}
+
+		if data.Exp > 0 && entry.isUsed() {
+			e.cache.Set(rec.Key, entry, cachestore.Expiration(rec, data.Exp))
+		}
+	}
+
+	e.log.Info("images",
+		zap.String("act", "restore"),
+		zap.Int("count", e.cache.ItemCount()))
+}
+
+// Save stores the cached images, so they are available after restart.
+func (e *ImageEmbedder) Save() error {
+	if e.store == nil {
+		return nil
+	}
+
+	items := e.cache.Items()
+	records := make([]cachestore.Record, 0, len(items))
+
+	for tag, item := range items {
+		data, access, load := item.Object.(*imageEntry).get()
+		value, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		records = append(records, cachestore.Record{
+			Key:    tag,
+			Value:  value,
+			Access: access,
+			Load:   load,
+		})
+	}
+
+	return e.store.Save(records)
+}
+
 func (e *ImageEmbedder) AddImageProvider(emb ImageProvider) {
 	e.es = append(e.es, emb)
 }
 
 func (e *ImageEmbedder) EmbedAll(html string) string {
-	return e.imgRe.ReplaceAllStringFunc(html, func(tag string) string {
-		return e.Convert(tag).Embed
-	})
+	rw := htmlwalk.Rewriter{
+		Image: func(tag, src string) string {
+			return e.Convert(tag).Embed
+		},
+	}
+
+	return rw.Rewrite(html)
 }
 
 func (e *ImageEmbedder) PreviewAll(html string) string {
-	return e.imgRe.ReplaceAllStringFunc(html, func(tag string) string {
-		return e.Convert(tag).Preview
-	})
+	rw := htmlwalk.Rewriter{
+		Image: func(tag, src string) string {
+			return e.Convert(tag).Preview
+		},
+	}
+
+	return rw.Rewrite(html)
 }
 
 func (e *ImageEmbedder) Convert(tag string) *ImageData {
-	var data *ImageData
+	cached, found := e.cache.Get(tag)
+	if !found {
+		src, _, ok := htmlwalk.ParseImage(tag)
+		if !ok {
+			return NewImageData(tag)
+		}
+
+		e.stat.Miss()
+		e.pool.Submit(tag, func() {
+			e.reload(tag, newImageEntry(NewImageData(tag)))
+		})
+
+		e.srcs.SetDefault(src, tag)
+
+		return newPendingImageData(tag)
+	}
+
+	e.stat.Hit()
+
+	entry := cached.(*imageEntry)
+	if entry.isExpired() {
+		// concurrent reloads of the same image are coalesced by the pool
+		e.pool.Submit(tag, func() { e.reload(tag, entry) })
+	}
+
+	return entry.use()
+}
+
+func (e *ImageEmbedder) pendingTag(src string) (string, bool) {
+	tag, found := e.srcs.Get(src)
+	if !found {
+		return "", false
+	}
+
+	return tag.(string), true
+}
+
+// Resolve returns the loaded image with the source recently rendered as pending.
+// The second value is false if the image is still loading or unknown.
+func (e *ImageEmbedder) Resolve(src string) (*ImageData, bool) {
+	tag, found := e.pendingTag(src)
+	if !found {
+		return nil, false
+	}
 
 	cached, found := e.cache.Get(tag)
-	if found {
-		data = cached.(*ImageData)
-		if data.isExpired() {
-			go e.reload(tag, data)
+	if !found {
+		return nil, false
+	}
+
+	return cached.(*imageEntry).use(), true
+}
+
+// IsPending reports whether the image is queued to be loaded.
+func (e *ImageEmbedder) IsPending(src string) bool {
+	tag, found := e.pendingTag(src)
+	return found && e.pool.IsPending(tag)
+}
+
+// Stats returns the number of cached images and the hit rate.
+func (e *ImageEmbedder) Stats() cachestore.Stats {
+	stats := e.stat.Stats(e.cache.ItemCount())
+	stats.Dropped = e.pool.Dropped()
+
+	return stats
+}
+
+// cachedTags returns the cached image tags with the source.
+func (e *ImageEmbedder) cachedTags(src string) []string {
+	var tags []string
+	for tag := range e.cache.Items() {
+		if tagSrc, _, ok := htmlwalk.ParseImage(tag); ok && tagSrc == src {
+			tags = append(tags, tag)
 		}
-	} else {
-		data = NewImageData(tag)
-		e.reload(tag, data)
 	}
 
-	data.access = time.Now()
+	return tags
+}
+
+// Lookup describes the cached images with the source.
+// The same image may be cached several times with different attributes.
+func (e *ImageEmbedder) Lookup(src string) []cachestore.Info {
+	var infos []cachestore.Info
+	for _, tag := range e.cachedTags(src) {
+		cached, exp, found := e.cache.GetWithExpiration(tag)
+		if !found {
+			continue
+		}
 
-	return data
+		info := cached.(*imageEntry).info(src, exp)
+		info.Pending = e.pool.IsPending(tag)
+		infos = append(infos, info)
+	}
+
+	return infos
 }
 
-func (e *ImageEmbedder) reload(tag string, data *ImageData) {
-	match := e.propRe.FindAllStringSubmatch(tag, -1)
-	if len(match) == 0 {
-		return
+// Purge removes the images with the source from the cache,
+// so they are loaded again when they are shown next time.
+func (e *ImageEmbedder) Purge(src string) int {
+	tags := e.cachedTags(src)
+	for _, tag := range tags {
+		cached, found := e.cache.Get(tag)
+		if !found {
+			continue
+		}
+
+		cached.(*imageEntry).purge()
+		e.cache.Delete(tag)
 	}
 
-	props := match[0][1] + match[0][3]
-	href := match[0][2]
+	return len(tags)
+}
+
+// Reload loads the cached images with the source again in background.
+func (e *ImageEmbedder) Reload(src string) int {
+	var count int
+	for _, tag := range e.cachedTags(src) {
+		cached, found := e.cache.Get(tag)
+		if !found {
+			continue
+		}
+
+		tag := tag
+		entry := cached.(*imageEntry)
+		if e.pool.Submit(tag, func() { e.reload(tag, entry) }) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (e *ImageEmbedder) reload(tag string, entry *imageEntry) {
+	href, props, ok := htmlwalk.ParseImage(tag)
+	if !ok {
+		return
+	}
 
 	e.log.Info("images",
 		zap.String("act", "load"),
@@ -126,10 +441,12 @@ func (e *ImageEmbedder) reload(tag string, data *ImageData) {
 
 	var img *ImageData
 	var err error
+	var provider string
 
 	for _, ep := range e.es {
 		img, err = ep.Load(href, props)
 		if err == nil {
+			provider = fmt.Sprintf("%T", ep)
 			break
 		}
 		if !errors.Is(err, errorNoMatch) {
@@ -137,16 +454,26 @@ func (e *ImageEmbedder) reload(tag string, data *ImageData) {
 		}
 	}
 
+	var data *ImageData
 	if img == nil || err != nil {
-		return
+		data = NewImageData(tag)
+	} else {
+		data = &ImageData{
+			Embed:   img.Embed,
+			Preview: img.Preview,
+			Url:     img.Url,
+			Width:   img.Width,
+			Height:  img.Height,
+			Exp:     img.Exp,
+		}
 	}
 
-	data.Embed = img.Embed
-	data.Preview = img.Preview
-	data.Exp = img.Exp
-	data.load = time.Now()
-
-	if data.Exp > 0 {
-		e.cache.Set(tag, data, data.Exp)
+	if data.Exp <= 0 {
+		data.Exp = retryExp
 	}
+
+	entry.set(data, provider)
+
+	// the image may be purged while it is loading
+	entry.keep(e.cache, tag, data.Exp)
 }
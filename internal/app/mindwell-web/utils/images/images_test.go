@@ -0,0 +1,318 @@
+package images
+
+import (
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/workpool"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingProvider struct {
+	mu         sync.Mutex
+	loads      map[string]int
+	fail       bool
+	processing bool
+}
+
+func (cp *countingProvider) Load(href, props string) (*ImageData, error) {
+	time.Sleep(time.Millisecond)
+
+	cp.mu.Lock()
+	if cp.loads == nil {
+		cp.loads = make(map[string]int)
+	}
+	cp.loads[href]++
+	cp.mu.Unlock()
+
+	if cp.fail {
+		return nil, errors.New("load failed")
+	}
+
+	data := &ImageData{
+		Embed:   `<picture><img src="` + href + `"></picture>`,
+		Preview: `<img src="` + href + `">`,
+		Url:     href,
+		Width:   800,
+		Height:  600,
+	}
+
+	if !cp.processing {
+		data.Exp = time.Hour
+	}
+
+	return data, nil
+}
+
+func (cp *countingProvider) count(href string) int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.loads[href]
+}
+
+func newTestImageEmbedder(eps ...ImageProvider) *ImageEmbedder {
+	return &ImageEmbedder{
+		es:    eps,
+		cache: cache.New(time.Hour, time.Hour),
+		pool:  workpool.New(4, 1024, zap.NewNop()),
+		srcs:  cache.New(time.Hour, time.Hour),
+		log:   zap.NewNop(),
+	}
+}
+
+func testImage(i int) (tag, src string) {
+	src = "https://example.com/" + strconv.Itoa(i) + ".jpg"
+	return `<img src="` + src + `">`, src
+}
+
+func waitLoaded(t *testing.T, e *ImageEmbedder, srcs ...string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, src := range srcs {
+		for e.IsPending(src) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is still loading", src)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestImageEmbedderConcurrentConvert(t *testing.T) {
+	cp := &countingProvider{}
+	e := newTestImageEmbedder(cp)
+
+	const images = 10
+
+	var wg sync.WaitGroup
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < images; i++ {
+				tag, _ := testImage(i)
+				e.EmbedAll("<p>" + tag + "</p>")
+				e.PreviewAll(tag)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < images; i++ {
+		_, src := testImage(i)
+		waitLoaded(t, e, src)
+
+		if n := cp.count(src); n != 1 {
+			t.Errorf("%s is loaded %d times", src, n)
+		}
+
+		img, ok := e.Resolve(src)
+		if !ok {
+			t.Errorf("%s is not resolved", src)
+			continue
+		}
+
+		if img.Url != src {
+			t.Errorf("%s: got url %q", src, img.Url)
+		}
+	}
+}
+
+func TestImageEmbedderConcurrentAdmin(t *testing.T) {
+	e := newTestImageEmbedder(&countingProvider{})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				tag, src := testImage(i % 5)
+				switch (g + i) % 5 {
+				case 0, 1:
+					e.Convert(tag)
+				case 2:
+					e.Reload(src)
+				case 3:
+					e.Purge(src)
+				case 4:
+					e.Lookup(src)
+					e.Stats()
+					e.Resolve(src)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := 0; i < 5; i++ {
+		_, src := testImage(i)
+		waitLoaded(t, e, src)
+	}
+
+	if err := e.Save(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImageEmbedderCachesUnfinishedImages(t *testing.T) {
+	tests := []struct {
+		name string
+		cp   *countingProvider
+	}{
+		{"processing", &countingProvider{processing: true}},
+		{"failed", &countingProvider{fail: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestImageEmbedder(tt.cp)
+
+			tag, src := testImage(1)
+			e.Convert(tag)
+			waitLoaded(t, e, src)
+
+			img, ok := e.Resolve(src)
+			if !ok {
+				t.Fatal("the image is not cached")
+			}
+
+			if img.Exp != retryExp {
+				t.Errorf("got expiration %s, want %s", img.Exp, retryExp)
+			}
+
+			e.Convert(tag)
+			waitLoaded(t, e, src)
+
+			if n := tt.cp.count(src); n != 1 {
+				t.Errorf("the image is loaded %d times", n)
+			}
+		})
+	}
+}
+
+// blockingProvider loads the image only when the test releases it.
+type blockingProvider struct {
+	started chan string
+	release chan struct{}
+}
+
+func newBlockingProvider() *blockingProvider {
+	return &blockingProvider{
+		started: make(chan string),
+		release: make(chan struct{}),
+	}
+}
+
+func (bp *blockingProvider) Load(href, props string) (*ImageData, error) {
+	bp.started <- href
+	<-bp.release
+
+	return &ImageData{Embed: href, Preview: href, Url: href, Exp: time.Hour}, nil
+}
+
+func (bp *blockingProvider) load() {
+	<-bp.started
+	bp.release <- struct{}{}
+}
+
+func TestImageEmbedderPurgeWhileLoading(t *testing.T) {
+	bp := newBlockingProvider()
+	e := newTestImageEmbedder(bp)
+	tag, src := testImage(1)
+
+	e.Convert(tag)
+	bp.load()
+	waitLoaded(t, e, src)
+
+	if n := e.Reload(src); n != 1 {
+		t.Fatalf("%d images are reloaded", n)
+	}
+
+	<-bp.started
+	if n := e.Purge(src); n != 1 {
+		t.Fatalf("%d images are purged", n)
+	}
+	bp.release <- struct{}{}
+	waitLoaded(t, e, src)
+
+	if _, found := e.cache.Get(tag); found {
+		t.Fatal("the purged image is cached again")
+	}
+
+	e.Convert(tag)
+	bp.load()
+	waitLoaded(t, e, src)
+
+	cached, found := e.cache.Get(tag)
+	if !found {
+		t.Fatal("the image is not loaded after the purge")
+	}
+	if cached.(*imageEntry).isPurged() {
+		t.Error("the purged image is cached")
+	}
+}
+
+func TestImageEmbedderReloadAfterPurge(t *testing.T) {
+	cp := &countingProvider{}
+	e := newTestImageEmbedder(cp)
+	tag, src := testImage(1)
+
+	e.Convert(tag)
+	waitLoaded(t, e, src)
+
+	if n := e.Purge(src); n != 1 {
+		t.Fatalf("%d images are purged", n)
+	}
+	if n := e.Reload(src); n != 0 {
+		t.Fatalf("%d purged images are reloaded", n)
+	}
+
+	e.Convert(tag)
+	waitLoaded(t, e, src)
+
+	if n := cp.count(src); n != 2 {
+		t.Errorf("%s is loaded %d times", src, n)
+	}
+	if _, found := e.cache.Get(tag); !found {
+		t.Error("the image is not loaded after the purge")
+	}
+}
+
+func TestImageEmbedderConcurrentPurgeAndReload(t *testing.T) {
+	e := newTestImageEmbedder(&countingProvider{})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tag, src := testImage(i % 3)
+				switch (g + i) % 3 {
+				case 0:
+					e.Convert(tag)
+				case 1:
+					e.Reload(src)
+				case 2:
+					e.Purge(src)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := 0; i < 3; i++ {
+		tag, src := testImage(i)
+		waitLoaded(t, e, src)
+
+		if cached, found := e.cache.Get(tag); found && cached.(*imageEntry).isPurged() {
+			t.Errorf("the purged image %s is cached", src)
+		}
+	}
+}
@@ -6,13 +6,33 @@ import (
 	"fmt"
 	"github.com/sevings/mindwell-server/models"
 	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"golang.org/x/net/html"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// imageSize is the size of the image with optional urls of the same image in modern formats.
+type imageSize struct {
+	models.ImageSize
+	Formats map[string]string `json:"formats,omitempty"`
+}
+
+// imageInfo extends the image model with the data sent by newer image servers.
+type imageInfo struct {
+	models.Image
+	Large  *imageSize `json:"large,omitempty"`
+	Medium *imageSize `json:"medium,omitempty"`
+	Small  *imageSize `json:"small,omitempty"`
+	Color  string     `json:"color,omitempty"`
+	// Blurhash is the blurred preview shown while the image is loading.
+	Blurhash string `json:"blurhash,omitempty"`
+}
+
 type mindwellProvider struct {
 	cli     *http.Client
 	mi      *utils.Mindwell
@@ -40,6 +60,10 @@ func (e *mindwellProvider) Load(href, props string) (*ImageData, error) {
 		return nil, err
 	}
 
+	if info.Large == nil {
+		return nil, errors.New("image has no sizes: " + href)
+	}
+
 	var img *ImageData
 
 	if info.IsAnimated {
@@ -51,6 +75,10 @@ func (e *mindwellProvider) Load(href, props string) (*ImageData, error) {
 		return nil, err
 	}
 
+	img.Url = info.Large.URL
+	img.Width = info.Large.Width
+	img.Height = info.Large.Height
+
 	if !info.Processing {
 		img.Exp = 180 * 24 * time.Hour
 	}
@@ -58,7 +86,7 @@ func (e *mindwellProvider) Load(href, props string) (*ImageData, error) {
 	return img, nil
 }
 
-func (e *mindwellProvider) loadImageInfo(href string) (*models.Image, error) {
+func (e *mindwellProvider) loadImageInfo(href string) (*imageInfo, error) {
 	href = strings.SplitN(href, "?", 2)[0]
 	href = url.QueryEscape(href)
 	req, err := http.NewRequest(http.MethodGet, e.apiUrl+href, nil)
@@ -82,7 +110,7 @@ func (e *mindwellProvider) loadImageInfo(href string) (*models.Image, error) {
 		return nil, errors.New(string(body))
 	}
 
-	var imgInfo = &models.Image{}
+	var imgInfo = &imageInfo{}
 	err = json.Unmarshal(body, imgInfo)
 	if err != nil {
 		return nil, err
@@ -91,7 +119,7 @@ func (e *mindwellProvider) loadImageInfo(href string) (*models.Image, error) {
 	return imgInfo, nil
 }
 
-func (e *mindwellProvider) getAnimated(info *models.Image, props string) (*ImageData, error) {
+func (e *mindwellProvider) getAnimated(info *imageInfo, props string) (*ImageData, error) {
 	img := &ImageData{}
 
 	{
@@ -112,10 +140,11 @@ func (e *mindwellProvider) getAnimated(info *models.Image, props string) (*Image
 	}
 
 	{
-		preview := info.Medium.Preview
-		gif := info.Medium.URL
-		w := info.Medium.Width
-		h := info.Medium.Height
+		medium := firstSize(info.Medium, info.Large)
+		preview := medium.Preview
+		gif := medium.URL
+		w := medium.Width
+		h := medium.Height
 
 		const tag = `
 <img class="gif-play-image" data-gif="%s" data-scope="attached" 
@@ -129,41 +158,176 @@ func (e *mindwellProvider) getAnimated(info *models.Image, props string) (*Image
 	return img, nil
 }
 
-func (e *mindwellProvider) getStatic(info *models.Image, props string) (*ImageData, error) {
-	img := &ImageData{}
+// pictureFormats are the alternative formats in the order of preference.
+var pictureFormats = []string{"avif", "webp"}
 
-	{
-		mediumUrl := info.Medium.URL
-		largeUrl := info.Large.URL
-		w := info.Medium.Width
-		h := info.Medium.Height
+// layoutSizes are the widths of the images in the layouts of the media filter modes.
+// The full content is shown in the entry column and the previews are shown in the feed cards.
+var layoutSizes = map[string]string{
+	"embed":   "(min-width: 1200px) 67vw, (min-width: 992px) 83vw, 100vw",
+	"preview": "(min-width: 1200px) 33vw, (min-width: 768px) 50vw, 100vw",
+}
 
-		const tag = `
-<a href="%s" target="__blank" class="post-thumb js-zoom-image">
-	<img src="%s" %s
-		srcset="%s, %s 1.5x"
-		width="%d" height="%d">
-</a>
-`
+var colorRe = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}){1,2}$`)
 
-		img.Embed = fmt.Sprintf(tag, largeUrl, mediumUrl, props, mediumUrl, largeUrl, w, h)
+// firstSize returns the first size the image server has sent.
+func firstSize(sizes ...*imageSize) *imageSize {
+	for _, size := range sizes {
+		if size != nil {
+			return size
+		}
 	}
 
-	{
-		smallUrl := info.Small.URL
-		mediumUrl := info.Medium.URL
-		largeUrl := info.Large.URL
-		w := info.Small.Width
-		h := info.Small.Height
+	return nil
+}
+
+// srcset lists the urls of the sizes in the format with their widths.
+// The empty format means the original one.
+func srcset(format string, sizes ...*imageSize) string {
+	var items []string
+	for _, size := range sizes {
+		if size == nil {
+			continue
+		}
+
+		src := size.URL
+		if format != "" {
+			src = size.Formats[format]
+		}
+
+		if src != "" {
+			items = append(items, fmt.Sprintf("%s %dw", src, size.Width))
+		}
+	}
+
+	return strings.Join(items, ", ")
+}
+
+// placeholderStyle shows the blurred image or the dominant colour while the image is loading,
+// so the masonry feed does not look empty.
+func placeholderStyle(info *imageInfo, fallback *imageSize) string {
+	var rules []string
+	if colorRe.MatchString(info.Color) {
+		rules = append(rules, "background-color: "+info.Color)
+	}
+
+	if info.Blurhash != "" {
+		blur, err := blurhashUrl(info.Blurhash, fallback.Width, fallback.Height)
+		if err == nil {
+			rules = append(rules, "background-image: url("+blur+")", "background-size: cover")
+		}
+	}
+
+	return strings.Join(rules, "; ")
+}
+
+type imgAttr struct {
+	key, val string
+}
+
+// imgTag merges the attributes of the original tag with the rendered ones.
+// The rendered attributes replace the original ones, while the original loading and decoding
+// attributes take precedence over the defaults. The placeholder is added to the original style.
+func imgTag(props string, attrs, defaults []imgAttr, style string) string {
+	set := make(map[string]bool)
+	for _, attr := range attrs {
+		set[attr.key] = true
+	}
+
+	z := html.NewTokenizer(strings.NewReader("<img" + props + ">"))
+	z.Next()
+	_, hasAttr := z.TagName()
+	for hasAttr {
+		var key, val []byte
+		key, val, hasAttr = z.TagAttr()
+
+		name := string(key)
+		if set[name] {
+			continue
+		}
+
+		value := string(val)
+		if name == "style" && style != "" {
+			value = style + "; " + value
+			style = ""
+		}
+
+		set[name] = true
+		attrs = append(attrs, imgAttr{name, value})
+	}
+
+	for _, attr := range defaults {
+		if !set[attr.key] {
+			attrs = append(attrs, attr)
+		}
+	}
+
+	if style != "" {
+		attrs = append(attrs, imgAttr{"style", style})
+	}
+
+	var b strings.Builder
+	b.WriteString("<img")
+	for _, attr := range attrs {
+		fmt.Fprintf(&b, ` %s="%s"`, attr.key, html.EscapeString(attr.val))
+	}
+	b.WriteString(">")
+
+	return b.String()
+}
+
+// picture renders the image with sources of modern formats if the image server provides them.
+// The fallback is shown with the intrinsic size, so the layout does not reflow while loading.
+func picture(info *imageInfo, fallback *imageSize, sizes []*imageSize, props, mode string) string {
+	sizesAttr := layoutSizes[mode]
+
+	var b strings.Builder
+	b.WriteString("<picture>")
 
+	for _, format := range pictureFormats {
+		if set := srcset(format, sizes...); set != "" {
+			fmt.Fprintf(&b, `
+	<source type="image/%s" srcset="%s" sizes="%s">`, format, set, sizesAttr)
+		}
+	}
+
+	attrs := []imgAttr{
+		{"src", fallback.URL},
+		{"srcset", srcset("", sizes...)},
+		{"sizes", sizesAttr},
+		{"width", strconv.FormatInt(fallback.Width, 10)},
+		{"height", strconv.FormatInt(fallback.Height, 10)},
+	}
+
+	defaults := []imgAttr{
+		{"loading", "lazy"},
+		{"decoding", "async"},
+	}
+
+	b.WriteString("\n\t")
+	b.WriteString(imgTag(props, attrs, defaults, placeholderStyle(info, fallback)))
+	b.WriteString("\n</picture>")
+
+	return b.String()
+}
+
+func (e *mindwellProvider) getStatic(info *imageInfo, props string) (*ImageData, error) {
+	img := &ImageData{}
+
+	{
 		const tag = `
-<img src="%s" %s
-	srcset="%s, %s 2x, %s 3x"
-	width="%d" height="%d">
+<a href="%s" target="__blank" class="post-thumb js-zoom-image">
+	%s
+</a>
 `
 
-		img.Preview = fmt.Sprintf(tag, smallUrl, props, smallUrl, mediumUrl, largeUrl, w, h)
+		medium := firstSize(info.Medium, info.Large)
+		pic := picture(info, medium, []*imageSize{info.Medium, info.Large}, props, "embed")
+		img.Embed = fmt.Sprintf(tag, info.Large.URL, pic)
 	}
 
+	small := firstSize(info.Small, info.Medium, info.Large)
+	img.Preview = picture(info, small, []*imageSize{info.Small, info.Medium, info.Large}, props, "preview")
+
 	return img, nil
 }
@@ -0,0 +1,165 @@
+package images
+
+import (
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func testSize(url string, width, height int64, formats map[string]string) *imageSize {
+	size := &imageSize{Formats: formats}
+	size.URL = url
+	size.Width = width
+	size.Height = height
+
+	return size
+}
+
+func testInfo() *imageInfo {
+	return &imageInfo{
+		Large:  testSize("/l.jpg", 1600, 1200, map[string]string{"webp": "/l.webp"}),
+		Medium: testSize("/m.jpg", 800, 600, map[string]string{"webp": "/m.webp", "avif": "/m.avif"}),
+		Small:  testSize("/s.jpg", 400, 300, nil),
+		Color:  "#a0b0c0",
+	}
+}
+
+func TestPictureLayouts(t *testing.T) {
+	info := testInfo()
+	e := &mindwellProvider{}
+
+	img, err := e.getStatic(info, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(img.Embed, `sizes="`+layoutSizes["embed"]+`"`) {
+		t.Errorf("no entry layout sizes in %s", img.Embed)
+	}
+	if !strings.Contains(img.Preview, `sizes="`+layoutSizes["preview"]+`"`) {
+		t.Errorf("no feed layout sizes in %s", img.Preview)
+	}
+
+	if !strings.Contains(img.Embed, `<source type="image/avif" srcset="/m.avif 800w"`) {
+		t.Errorf("no avif source in %s", img.Embed)
+	}
+	if !strings.Contains(img.Embed, `srcset="/m.webp 800w, /l.webp 1600w"`) {
+		t.Errorf("no webp source in %s", img.Embed)
+	}
+	if !strings.Contains(img.Preview, `src="/s.jpg"`) || !strings.Contains(img.Preview, `width="400" height="300"`) {
+		t.Errorf("no small fallback in %s", img.Preview)
+	}
+
+	if (&ImageData{Embed: "e", Preview: "p"}).Mode("placeholder") != "e" {
+		t.Error("placeholder mode must show the entry layout")
+	}
+	if (&ImageData{Embed: "e", Preview: "p"}).Mode("") != "p" {
+		t.Error("default mode must show the feed layout")
+	}
+}
+
+func TestPictureMergesAttributes(t *testing.T) {
+	info := testInfo()
+
+	props := ` alt="a &quot;cat&quot;" loading="eager" width="10" sizes="1px" style="border: 0"`
+	pic := picture(info, info.Medium, []*imageSize{info.Medium, info.Large}, props, "embed")
+
+	for attr, count := range map[string]int{
+		` loading=`:                        1,
+		` decoding=`:                       1,
+		` width=`:                          1,
+		` style=`:                          1,
+		` loading="eager"`:                 1,
+		` width="800"`:                     1,
+		` alt="a &#34;cat&#34;"`:           1,
+		`style="background-color: #a0b0c0`: 1,
+		`border: 0"`:                       1,
+		`sizes="1px"`:                      0,
+	} {
+		if got := strings.Count(pic, attr); got != count {
+			t.Errorf("%s found %d times in %s", attr, got, pic)
+		}
+	}
+}
+
+func TestPictureWithoutSizes(t *testing.T) {
+	info := testInfo()
+	info.Medium = nil
+	info.Small = nil
+
+	e := &mindwellProvider{}
+
+	img, err := e.getStatic(info, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(img.Embed, `src="/l.jpg"`) || !strings.Contains(img.Preview, `src="/l.jpg"`) {
+		t.Errorf("large size is not used: %s %s", img.Embed, img.Preview)
+	}
+
+	info.IsAnimated = true
+	img, err = e.getAnimated(info, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(img.Preview, `data-gif="/l.jpg"`) {
+		t.Errorf("large size is not used: %s", img.Preview)
+	}
+}
+
+func encode83(value, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = blurhashChars[value%83]
+		value /= 83
+	}
+
+	return string(b)
+}
+
+func TestDecodeBlurhash(t *testing.T) {
+	hash := encode83(0, 1) + encode83(0, 1) + encode83(0x336699, 4)
+
+	img, err := decodeBlurhash(hash, 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := color.NRGBA{R: 0x33, G: 0x66, B: 0x99, A: 255}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			if got := img.At(x, y); got != want {
+				t.Fatalf("got %v at %d,%d, want %v", got, x, y, want)
+			}
+		}
+	}
+
+	_, err = decodeBlurhash("LEHV6nWB2yk8pyo0adR*.7kCMdnj", 16, 12)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, hash := range []string{"", "LEHV6", "LEHV6nWB2yk8pyo0adR*.7kCMdn", "LEHV6nWB2yk8pyo0adR*.7kCMdn\""} {
+		if _, err := decodeBlurhash(hash, 4, 3); err == nil {
+			t.Errorf("%q must be invalid", hash)
+		}
+	}
+}
+
+func TestBlurhashPlaceholder(t *testing.T) {
+	info := testInfo()
+	info.Blurhash = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+
+	style := placeholderStyle(info, info.Medium)
+	if !strings.Contains(style, "background-image: url(data:image/png;base64,") {
+		t.Errorf("no blurhash in %s", style)
+	}
+
+	info.Blurhash = "invalid"
+	info.Color = "red; background: url(http://evil.com)"
+	if style := placeholderStyle(info, info.Medium); style != "" {
+		t.Errorf("got style %s", style)
+	}
+}
@@ -0,0 +1,283 @@
+package mediaproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/safehttp"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrorNotFound = errors.New("mediaproxy: the image is not available")
+
+var contentTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+}
+
+// Proxy serves third-party images from the web host,
+// so readers' addresses are not leaked and pages have no mixed content.
+type Proxy struct {
+	secret  []byte
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+	local   []string
+	cli     *http.Client
+	log     *zap.Logger
+}
+
+func NewProxy(m *utils.Mindwell) *Proxy {
+	maxSize := int64(m.ConfigInt("proxy.max_size"))
+	if maxSize <= 0 {
+		maxSize = 10 * 1024
+	}
+
+	days := m.ConfigInt("proxy.cache_days")
+	if days <= 0 {
+		days = 30
+	}
+
+	p := &Proxy{
+		secret:  m.ConfigBytes("proxy.secret"),
+		dir:     m.ConfigString("proxy.cache_dir"),
+		maxSize: maxSize * 1024,
+		ttl:     time.Duration(days) * 24 * time.Hour,
+		local: []string{
+			m.ConfigString("web.proto") + "://" + m.ConfigString("web.domain") + "/",
+			m.ConfigString("images.proto") + "://" + m.ConfigString("images.domain") + "/",
+		},
+		log: m.LogSystem(),
+	}
+
+	// one more byte to detect too large images
+	p.cli = safehttp.NewClient(10*time.Second, p.maxSize+1, contentTypes...)
+
+	if p.IsEnabled() && p.dir != "" {
+		go p.clean()
+	}
+
+	return p
+}
+
+// IsEnabled reports whether the secret to sign urls is configured.
+func (p *Proxy) IsEnabled() bool {
+	return len(p.secret) > 0
+}
+
+func (p *Proxy) sign(src string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(src))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of the url.
+func (p *Proxy) Verify(src, sig string) bool {
+	if !p.IsEnabled() {
+		return false
+	}
+
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	actual, _ := hex.DecodeString(p.sign(src))
+	return hmac.Equal(expected, actual)
+}
+
+// URL returns the proxied url of the image.
+// Local images and images without a proxy secret are returned as is.
+func (p *Proxy) URL(src string) string {
+	if !p.IsEnabled() || src == "" {
+		return src
+	}
+
+	u, err := url.Parse(src)
+	if err != nil || u.Host == "" {
+		return src
+	}
+
+	switch u.Scheme {
+	case "":
+		src = "https:" + src
+	case "http", "https":
+	default:
+		return src
+	}
+
+	for _, prefix := range p.local {
+		if strings.HasPrefix(src, prefix) {
+			return src
+		}
+	}
+
+	return "/proxy/img?u=" + url.QueryEscape(src) + "&sig=" + p.sign(src)
+}
+
+func (p *Proxy) cachePath(src string) string {
+	sum := sha256.Sum256([]byte(src))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(p.dir, name[:2], name)
+}
+
+// Load returns the image data and its content type, from the disk cache if possible.
+func (p *Proxy) Load(src string) ([]byte, string, error) {
+	if p.dir != "" {
+		data, contentType, err := p.loadCached(src)
+		if err == nil {
+			return data, contentType, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			p.log.Warn("mediaproxy", zap.Error(err))
+		}
+	}
+
+	data, contentType, err := p.fetch(src)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if p.dir != "" {
+		err = p.saveCached(src, data, contentType)
+		if err != nil {
+			p.log.Warn("mediaproxy", zap.Error(err))
+		}
+	}
+
+	return data, contentType, nil
+}
+
+func (p *Proxy) fetch(src string) ([]byte, string, error) {
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, "", ErrorNotFound
+	}
+
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.Set("Accept", strings.Join(contentTypes, ", "))
+	req.Header.Set("User-Agent", "mindwell-web")
+
+	resp, err := p.cli.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", ErrorNotFound
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if int64(len(data)) > p.maxSize {
+		return nil, "", fmt.Errorf("mediaproxy: the image is too large: %s", src)
+	}
+
+	contentType := strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+
+	return data, contentType, nil
+}
+
+// cached files start with the content type line
+func (p *Proxy) loadCached(src string) ([]byte, string, error) {
+	path := p.cachePath(src)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if time.Since(info.ModTime()) > p.ttl {
+		return nil, "", fs.ErrNotExist
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType, data, found := bytes.Cut(file, []byte("\n"))
+	if !found {
+		return nil, "", errors.New("mediaproxy: invalid cache file: " + path)
+	}
+
+	return data, string(contentType), nil
+}
+
+func (p *Proxy) saveCached(src string, data []byte, contentType string) error {
+	path := p.cachePath(src)
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = tmp.WriteString(contentType + "\n")
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// clean removes expired files from the disk cache.
+func (p *Proxy) clean() {
+	for range time.Tick(24 * time.Hour) {
+		err := filepath.WalkDir(p.dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			info, err := d.Info()
+			if err == nil && time.Since(info.ModTime()) > p.ttl {
+				err = os.Remove(path)
+			}
+
+			return err
+		})
+
+		if err != nil {
+			p.log.Warn("mediaproxy", zap.Error(err))
+		}
+	}
+}
@@ -11,30 +11,39 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/flosch/pongo2"
 	goconf "github.com/zpatrick/go-config"
 )
 
 type Mindwell struct {
-	DevMode   bool
-	config    *goconf.Config
-	templates map[string]*pongo2.Template
-	log       *zap.Logger
-	path      string
-	host      string
-	scheme    string
-	uidSalt   string
-	apiID     string
-	apiSecret string
-	appToken  string
-	appTokThr time.Time
-	url       string
-	imgHost   string
-	imgUrl    string
+	DevMode     bool
+	config      *goconf.Config
+	templates   map[string]*pongo2.Template
+	log         *zap.Logger
+	path        string
+	host        string
+	scheme      string
+	uidSalt     string
+	apiID       string
+	apiSecret   string
+	appToken    string
+	appTokThr   time.Time
+	appTokMu    sync.Mutex
+	url         string
+	imgHost     string
+	imgUrl      string
+	transport   http.RoundTripper
+	client      *http.Client
+	breaker     *Breaker
+	apiCache    *apiCache
+	templateDir string
 }
 
 func loadConfig(fileName string) *goconf.Config {
@@ -57,6 +66,11 @@ func NewMindwell() *Mindwell {
 
 	m.installLogger()
 
+	m.templateDir = m.ConfigString("web.templates")
+	if m.templateDir == "" {
+		m.templateDir = "web/templates"
+	}
+
 	m.path = m.ConfigString("api.path")
 	m.host = m.ConfigString("api.host")
 	m.scheme = m.ConfigString("api.scheme")
@@ -67,6 +81,15 @@ func NewMindwell() *Mindwell {
 	m.imgHost = m.ConfigString("images.host")
 	m.imgUrl = m.scheme + "://" + m.imgHost + m.path
 
+	m.breaker = newBreaker(m)
+	m.transport = &breakerTransport{
+		base:    newApiTransport(m),
+		breaker: m.breaker,
+		host:    m.host,
+	}
+	m.apiCache = newApiCache(m)
+	m.client = m.HttpClient(m.configDuration("api.timeout", 30*time.Second, time.Second))
+
 	return m
 }
 
@@ -122,6 +145,23 @@ func (m *Mindwell) ConfigInt(key string) int {
 	return value
 }
 
+// ConfigStrings returns a list of values separated by commas or spaces.
+// TOML arrays of strings are accepted as well.
+func (m *Mindwell) ConfigStrings(key string) []string {
+	value := m.ConfigString(key)
+	value = strings.TrimPrefix(value, "[")
+	value = strings.TrimSuffix(value, "]")
+
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// TemplatePath returns the path to the template file in the configured directory.
+func (m *Mindwell) TemplatePath(name string) string {
+	return filepath.Join(m.templateDir, name)
+}
+
 func (m *Mindwell) Template(name string) (*pongo2.Template, error) {
 	return m.TemplateWithExtension(name + ".html")
 }
@@ -133,7 +173,7 @@ func (m *Mindwell) TemplateWithExtension(name string) (*pongo2.Template, error)
 		}
 	}
 
-	t, err := pongo2.FromFile("web/templates/" + name)
+	t, err := pongo2.FromFile(m.TemplatePath(name))
 	if err != nil {
 		m.LogSystem().Error(err.Error())
 		return t, err
@@ -213,7 +253,12 @@ type appToken struct {
 	TokenType   string `json:"token_type"`
 }
 
+// AppToken is called by the request handlers and the background workers,
+// so the token is refreshed only once.
 func (m *Mindwell) AppToken() string {
+	m.appTokMu.Lock()
+	defer m.appTokMu.Unlock()
+
 	if m.appTokThr.After(time.Now()) {
 		return m.appToken
 	}
@@ -235,7 +280,7 @@ func (m *Mindwell) AppToken() string {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("User-Agent", "MindwellWeb")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := m.client.Do(req)
 	if err != nil {
 		m.LogSystem().Error(err.Error())
 		return ""
@@ -273,6 +318,22 @@ func (m *Mindwell) AppToken() string {
 	return m.appToken
 }
 
+// HttpClient returns the client to the API and image servers sharing the pooled connections.
+func (m *Mindwell) HttpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: m.transport,
+		Timeout:   timeout,
+	}
+}
+
+func (m *Mindwell) Breaker() *Breaker {
+	return m.breaker
+}
+
+func (m *Mindwell) ApiUrl() string {
+	return m.url
+}
+
 func (m *Mindwell) ImgApiUrl() string {
 	return m.imgUrl
 }
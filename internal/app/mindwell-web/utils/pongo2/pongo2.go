@@ -2,23 +2,28 @@ package pongo2
 
 import (
 	"errors"
-	webUtils "github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
 	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/embedder"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/htmlwalk"
 	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils/images"
+	"html"
 	"log"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/flosch/pongo2"
 	"github.com/sevings/mindwell-server/utils"
 )
 
-func InitPongo2(m *webUtils.Mindwell) {
+func InitPongo2(linkEmb *embedder.Embedder, imgEmb *images.ImageEmbedder) {
 	registerFilter("quantity", quantity)
 	registerFilter("gender", gender)
-	registerFilter("media", media(m))
+	registerFilter("media", media(linkEmb, imgEmb))
 	registerFilter("cut_html", cutHtml)
 	registerFilter("cut_text", cutText)
+	registerFilter("plain_text", plainText)
+	registerFilter("unix_date", unixDate)
 }
 
 func registerFilter(name string, filter pongo2.FilterFunction) {
@@ -80,10 +85,8 @@ func gender(gender *pongo2.Value, _ *pongo2.Value) (*pongo2.Value, *pongo2.Error
 }
 
 // usage: {{ html|media:"embed" }}
-func media(m *webUtils.Mindwell) func(content *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
-	var linkEmb = embedder.NewEmbedder(m.LogSystem(), m.ConfigString("web.domain"))
-	var imgEmb = images.NewImageEmbedder(m, m.LogSystem())
-
+// The "placeholder" mode shows third-party embeds only on click.
+func media(linkEmb *embedder.Embedder, imgEmb *images.ImageEmbedder) func(content *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
 	return func(content *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
 		if content.IsNil() {
 			return content, nil
@@ -96,18 +99,28 @@ func media(m *webUtils.Mindwell) func(content *pongo2.Value, param *pongo2.Value
 			}
 		}
 
-		embed := param.String() == "embed"
+		mode := param.String()
 
 		html := content.String()
 
-		if embed {
-			html = imgEmb.EmbedAll(html)
-			html = linkEmb.EmbedAll(html)
-		} else {
-			html = imgEmb.PreviewAll(html)
-			html = linkEmb.PreviewAll(html)
+		rw := htmlwalk.Rewriter{
+			Link: func(tag, href string) string {
+				switch mode {
+				case "embed":
+					return linkEmb.Convert(tag, href).Embed()
+				case "placeholder":
+					return embedder.Placeholder(linkEmb.Convert(tag, href))
+				default:
+					return linkEmb.Convert(tag, href).Preview()
+				}
+			},
+			Image: func(tag, src string) string {
+				return imgEmb.Convert(tag).Mode(mode)
+			},
 		}
 
+		html = rw.Rewrite(html)
+
 		return pongo2.AsSafeValue(html), nil
 	}
 }
@@ -188,3 +201,48 @@ func cutText(content *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2
 
 	return pongo2.AsSafeValue(text), nil
 }
+
+// usage: <title>{{ entry.title|plain_text }}</title>
+func plainText(content *pongo2.Value, _ *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	if content.IsNil() {
+		return content, nil
+	}
+
+	if !content.IsString() {
+		return nil, &pongo2.Error{
+			Sender:    "filter:plain_text",
+			OrigError: errors.New("input value is not a string"),
+		}
+	}
+
+	text := utils.RemoveHTML(content.String())
+	text = html.UnescapeString(text)
+
+	return pongo2.AsValue(text), nil
+}
+
+// usage: {{ entry.createdAt|unix_date|date:"2006-01-02" }}
+func unixDate(content *pongo2.Value, _ *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	if content.IsNil() {
+		return content, nil
+	}
+
+	var sec float64
+	if content.IsNumber() {
+		sec = content.Float()
+	} else {
+		var err error
+		sec, err = strconv.ParseFloat(content.String(), 64)
+		if err != nil {
+			return nil, &pongo2.Error{
+				Sender:    "filter:unix_date",
+				OrigError: err,
+			}
+		}
+	}
+
+	whole, frac := math.Modf(sec)
+	date := time.Unix(int64(whole), int64(frac*1e9))
+
+	return pongo2.AsValue(date), nil
+}
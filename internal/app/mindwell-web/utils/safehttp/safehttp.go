@@ -0,0 +1,159 @@
+package safehttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const maxRedirects = 3
+
+var errorForbiddenAddress = errors.New("safehttp: the address is not public")
+
+var reservedNets = func() []*net.IPNet {
+	cidrs := []string{
+		"0.0.0.0/8",       // this network
+		"100.64.0.0/10",   // carrier-grade NAT
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // documentation
+		"198.18.0.0/15",   // benchmarking
+		"198.51.100.0/24", // documentation
+		"203.0.113.0/24",  // documentation
+		"240.0.0.0/4",     // reserved
+		"64:ff9b::/96",    // IPv4/IPv6 translation
+		"2001:db8::/32",   // documentation
+	}
+
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets
+}()
+
+// IsPublicIP rejects loopback, private, link-local (including cloud metadata) and reserved addresses.
+func IsPublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, ipNet := range reservedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkAddress is called after DNS resolution, so it also catches names pointing to internal hosts.
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !IsPublicIP(net.ParseIP(host)) {
+		return fmt.Errorf("%w: %s", errorForbiddenAddress, host)
+	}
+
+	return nil
+}
+
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// safeTransport limits the size and the types of responses.
+type safeTransport struct {
+	http.RoundTripper
+	maxSize      int64
+	contentTypes map[string]bool
+}
+
+func (st *safeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := st.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return resp, nil
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !st.contentTypes[contentType] {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("safehttp: content type is not allowed: %s", contentType)
+	}
+
+	resp.Body = &limitedBody{
+		Reader: io.LimitReader(resp.Body, st.maxSize),
+		Closer: resp.Body,
+	}
+
+	return resp, nil
+}
+
+// NewClient creates the client for requests to the links from user content.
+// It never connects to internal addresses and ignores proxy settings.
+// Response bodies are cut to maxSize, responses of other content types are rejected.
+func NewClient(timeout time.Duration, maxSize int64, contentTypes ...string) *http.Client {
+	return newClient(checkAddress, timeout, maxSize, contentTypes...)
+}
+
+func newClient(control func(network, address string, c syscall.RawConn) error,
+	timeout time.Duration, maxSize int64, contentTypes ...string) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: control,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+
+	allowed := make(map[string]bool, len(contentTypes))
+	for _, contentType := range contentTypes {
+		allowed[contentType] = true
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &safeTransport{
+			RoundTripper: transport,
+			maxSize:      maxSize,
+			contentTypes: allowed,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("safehttp: too many redirects")
+			}
+
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("safehttp: redirect to unsupported scheme")
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,195 @@
+package safehttp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// allowOnly treats the test server as a public host, other addresses are checked as usual.
+func allowOnly(srv *httptest.Server) func(network, address string, c syscall.RawConn) error {
+	allowed := srv.Listener.Addr().String()
+
+	return func(network, address string, c syscall.RawConn) error {
+		if address == allowed {
+			return nil
+		}
+
+		return checkAddress(network, address, c)
+	}
+}
+
+func newTestClient(srv *httptest.Server, maxSize int64, contentTypes ...string) *http.Client {
+	return newClient(allowOnly(srv), time.Second, maxSize, contentTypes...)
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+		{"8.8.8.8", true},
+		{"2a00:1450:4010:c05::8b", true},
+	}
+
+	for _, tt := range tests {
+		if got := IsPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("IsPublicIP(%s) = %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestRejectsLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("internal"))
+	}))
+	defer srv.Close()
+
+	cli := NewClient(time.Second, 1024, "text/html")
+	_, err := cli.Get(srv.URL)
+	if !errors.Is(err, errorForbiddenAddress) {
+		t.Fatalf("expected the forbidden address error, got %v", err)
+	}
+}
+
+func TestRejectsRedirectToLoopback(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("internal"))
+	}))
+	defer internal.Close()
+
+	target := internal.URL + "/secret"
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+	defer public.Close()
+
+	cli := newTestClient(public, 1024, "text/html")
+	_, err := cli.Get(public.URL)
+	if !errors.Is(err, errorForbiddenAddress) {
+		t.Fatalf("expected the forbidden address error, got %v", err)
+	}
+}
+
+func TestRedirectLimit(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if n > 0 {
+			http.Redirect(w, r, srv.URL+"/"+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	cli := newTestClient(srv, 1024, "text/html")
+
+	resp, err := cli.Get(srv.URL + "/" + strconv.Itoa(maxRedirects-1))
+	if err != nil {
+		t.Fatalf("redirects below the limit are not followed: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	_, err = cli.Get(srv.URL + "/" + strconv.Itoa(maxRedirects))
+	if err == nil || !strings.Contains(err.Error(), "too many redirects") {
+		t.Fatalf("expected the redirect limit error, got %v", err)
+	}
+}
+
+func TestRedirectToUnsupportedScheme(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://example.com/file", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	cli := newTestClient(srv, 1024, "text/html")
+	_, err := cli.Get(srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "unsupported scheme") {
+		t.Fatalf("expected the scheme error, got %v", err)
+	}
+}
+
+func TestContentTypeAllowlist(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		_, _ = w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	cli := newTestClient(srv, 1024, "text/html", "application/json")
+
+	tests := []struct {
+		contentType string
+		allowed     bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"application/json", true},
+		{"image/svg+xml", false},
+		{"application/octet-stream", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		resp, err := cli.Get(srv.URL + "/?type=" + url.QueryEscape(tt.contentType))
+		if tt.allowed {
+			if err != nil {
+				t.Errorf("%q: %v", tt.contentType, err)
+				continue
+			}
+			_ = resp.Body.Close()
+		} else if err == nil {
+			_ = resp.Body.Close()
+			t.Errorf("%q is not rejected", tt.contentType)
+		}
+	}
+}
+
+func TestBodySizeCap(t *testing.T) {
+	const maxSize = 1024
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(strings.Repeat("a", maxSize*4)))
+	}))
+	defer srv.Close()
+
+	cli := newTestClient(srv, maxSize, "text/plain")
+	resp, err := cli.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(body) != maxSize {
+		t.Errorf("got %d bytes, want %d", len(body), maxSize)
+	}
+}
@@ -0,0 +1,511 @@
+package sitemap
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/sevings/mindwell-server/models"
+	"github.com/sevings/mindwell-web/internal/app/mindwell-web/utils"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the limit of urls in a single sitemap file, see https://www.sitemaps.org/protocol.html
+const maxUrls = 50000
+
+const xmlns = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type urlEntry struct {
+	XMLName    xml.Name `xml:"url"`
+	Loc        string   `xml:"loc"`
+	LastMod    string   `xml:"lastmod,omitempty"`
+	ChangeFreq string   `xml:"changefreq,omitempty"`
+	Priority   string   `xml:"priority,omitempty"`
+	lastMod    time.Time
+}
+
+type urlSet struct {
+	XMLName xml.Name `xml:"urlset"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Urls    []urlEntry
+}
+
+type sitemapEntry struct {
+	XMLName xml.Name `xml:"sitemap"`
+	Loc     string   `xml:"loc"`
+	LastMod string   `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name `xml:"sitemapindex"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Sitemaps []sitemapEntry
+}
+
+// statusError is returned when the API responds with an unexpected status.
+type statusError struct {
+	path string
+	code int
+}
+
+func (se *statusError) Error() string {
+	return se.path + ": " + http.StatusText(se.code)
+}
+
+// isGone reports whether the tlog has been deleted or closed since it was found,
+// so it should be skipped instead of failing the whole sitemap.
+func isGone(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return false
+	}
+
+	return se.code == http.StatusNotFound || se.code == http.StatusForbidden
+}
+
+type Sitemap struct {
+	mi       *utils.Mindwell
+	cli      *http.Client
+	log      *zap.Logger
+	webUrl   string
+	apiUrl   string
+	interval time.Duration
+	tlogMax  int
+	pagesMax int
+
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+func NewSitemap(m *utils.Mindwell) *Sitemap {
+	interval := m.ConfigInt("sitemap.interval")
+	if interval <= 0 {
+		interval = 360
+	}
+
+	tlogMax := m.ConfigInt("sitemap.tlog_entries")
+	if tlogMax <= 0 {
+		tlogMax = 1000
+	}
+
+	pagesMax := m.ConfigInt("sitemap.live_pages")
+	if pagesMax <= 0 {
+		pagesMax = 100
+	}
+
+	return &Sitemap{
+		mi:       m,
+		cli:      m.HttpClient(10 * time.Second),
+		log:      m.LogSystem(),
+		webUrl:   m.ConfigString("web.proto") + "://" + m.ConfigString("web.domain"),
+		apiUrl:   m.ApiUrl(),
+		interval: time.Duration(interval) * time.Minute,
+		tlogMax:  tlogMax,
+		pagesMax: pagesMax,
+	}
+}
+
+// retryDelay is the first delay before the failed generation is repeated.
+// It is doubled after each failure up to the interval.
+const retryDelay = time.Minute
+
+// Start generates the sitemap in background and then regenerates it periodically.
+// If the generation fails, the previous sitemap is kept and the generation is retried soon.
+func (s *Sitemap) Start() {
+	go func() {
+		delay := retryDelay
+
+		for {
+			err := s.generate()
+			if err == nil {
+				delay = retryDelay
+				time.Sleep(s.interval)
+				continue
+			}
+
+			s.log.Error("sitemap generation failed",
+				zap.Error(err),
+				zap.Duration("retry", delay))
+
+			time.Sleep(delay)
+
+			delay *= 2
+			if delay > s.interval {
+				delay = s.interval
+			}
+		}
+	}()
+}
+
+// IsReady returns true if the sitemap has been generated at least once.
+func (s *Sitemap) IsReady() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.files != nil
+}
+
+// File returns the content of the sitemap file, e.g. sitemap.xml or sitemap-users.xml.
+func (s *Sitemap) File(name string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.files[name]
+	return data, ok
+}
+
+func (s *Sitemap) generate() error {
+	start := time.Now()
+
+	pages, err := s.pageUrls()
+	if err != nil {
+		return err
+	}
+
+	sets := map[string][]urlEntry{
+		"pages": pages,
+	}
+
+	var entries []urlEntry
+	for _, source := range []string{"users", "themes"} {
+		baseApiPath := "/" + source
+
+		tlogs, err := s.loadTlogs(source)
+		if err != nil {
+			return err
+		}
+
+		var tlogUrls []urlEntry
+		for _, name := range tlogs {
+			tlogUrl := urlEntry{
+				Loc:        s.webUrl + baseApiPath + "/" + name,
+				ChangeFreq: "daily",
+				Priority:   "0.7",
+			}
+
+			tlogEntries, err := s.loadEntries(baseApiPath + "/" + name)
+			if err != nil {
+				s.skipTlog(baseApiPath+"/"+name, err)
+				continue
+			}
+
+			if len(tlogEntries) > 0 {
+				tlogUrl.lastMod = tlogEntries[0].lastMod
+			}
+
+			tlogUrls = append(tlogUrls, tlogUrl)
+			entries = append(entries, tlogEntries...)
+		}
+
+		if len(tlogUrls) > maxUrls {
+			tlogUrls = tlogUrls[:maxUrls]
+		}
+
+		sets[source] = tlogUrls
+	}
+
+	for i := 0; i*maxUrls < len(entries); i++ {
+		end := (i + 1) * maxUrls
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		sets["entries-"+strconv.Itoa(i+1)] = entries[i*maxUrls : end]
+	}
+
+	files := make(map[string][]byte, len(sets)+1)
+	index := sitemapIndex{Xmlns: xmlns}
+
+	for _, name := range sortedNames(sets) {
+		urls := sets[name]
+		fileName := "sitemap-" + name + ".xml"
+
+		var lastMod time.Time
+		for i := range urls {
+			if !urls[i].lastMod.IsZero() {
+				urls[i].LastMod = formatDate(urls[i].lastMod)
+			}
+			if urls[i].lastMod.After(lastMod) {
+				lastMod = urls[i].lastMod
+			}
+		}
+
+		data, err := marshal(urlSet{Xmlns: xmlns, Urls: urls})
+		if err != nil {
+			return err
+		}
+
+		files[fileName] = data
+
+		ref := sitemapEntry{Loc: s.webUrl + "/" + fileName}
+		if !lastMod.IsZero() {
+			ref.LastMod = formatDate(lastMod)
+		}
+		index.Sitemaps = append(index.Sitemaps, ref)
+	}
+
+	data, err := marshal(index)
+	if err != nil {
+		return err
+	}
+
+	files["sitemap.xml"] = data
+
+	s.mu.Lock()
+	s.files = files
+	s.mu.Unlock()
+
+	s.log.Info("sitemap",
+		zap.Int("files", len(files)),
+		zap.Int("entries", len(entries)),
+		zap.Duration("duration", time.Since(start)))
+
+	return nil
+}
+
+func (s *Sitemap) pageUrls() ([]urlEntry, error) {
+	pages := []struct {
+		path     string
+		template string
+		freq     string
+		priority string
+	}{
+		{"/index.html", "index.html", "monthly", "1"},
+		{"/help/about", "about.html", "monthly", "0.9"},
+		{"/help/rules", "rules.html", "monthly", "0.9"},
+		{"/help/faq/", "faq/faq.html", "monthly", "0.9"},
+		{"/help/faq/invites", "faq/faq_invites.html", "monthly", "0.9"},
+		{"/help/faq/md", "faq/faq_md.html", "monthly", "0.9"},
+		{"/help/faq/votes", "faq/faq_votes.html", "monthly", "0.9"},
+	}
+
+	urls := make([]urlEntry, 0, len(pages)+2)
+
+	for _, page := range pages {
+		u := urlEntry{
+			Loc:        s.webUrl + page.path,
+			ChangeFreq: page.freq,
+			Priority:   page.priority,
+		}
+
+		info, err := os.Stat(s.mi.TemplatePath(page.template))
+		if err == nil {
+			u.lastMod = info.ModTime()
+		} else {
+			s.log.Warn("sitemap", zap.Error(err))
+		}
+
+		urls = append(urls, u)
+	}
+
+	feeds := []struct {
+		path     string
+		apiPath  string
+		priority string
+	}{
+		{"/live", "/entries/live", "0.95"},
+		{"/best", "/entries/best", "1"},
+	}
+
+	for _, f := range feeds {
+		u := urlEntry{
+			Loc:        s.webUrl + f.path,
+			ChangeFreq: "daily",
+			Priority:   f.priority,
+		}
+
+		var feed models.Feed
+		err := s.load(f.apiPath, url.Values{"limit": {"1"}}, &feed)
+		if err != nil {
+			s.log.Warn("sitemap", zap.String("path", f.apiPath), zap.Error(err))
+		} else if len(feed.Entries) > 0 {
+			u.lastMod = unixTime(feed.Entries[0].CreatedAt)
+		}
+
+		urls = append(urls, u)
+	}
+
+	return urls, nil
+}
+
+// loadTlogs finds the tlogs with recent entries in the live feed, since the app token
+// is not allowed to list users and themes. Only the tlogs open to everyone are returned.
+func (s *Sitemap) loadTlogs(source string) ([]string, error) {
+	var names []string
+	found := make(map[string]bool)
+	query := url.Values{
+		"limit":  {"100"},
+		"source": {source},
+	}
+
+	for page := 0; page < s.pagesMax; page++ {
+		var feed models.Feed
+		err := s.load("/entries/live", query, &feed)
+		if err != nil && page == 0 {
+			return nil, err
+		}
+		if err != nil {
+			// the tlogs found on the previous pages are still listed
+			s.log.Warn("sitemap", zap.String("source", source), zap.Error(err))
+			break
+		}
+
+		for _, entry := range feed.Entries {
+			if entry == nil || entry.User == nil || entry.IsAnonymous || found[entry.User.Name] {
+				continue
+			}
+
+			found[entry.User.Name] = true
+
+			var tlog models.Profile
+			err = s.load("/"+source+"/"+entry.User.Name, nil, &tlog)
+			if err != nil {
+				s.skipTlog("/"+source+"/"+entry.User.Name, err)
+				continue
+			}
+
+			if tlog.Privacy == "all" {
+				names = append(names, entry.User.Name)
+			}
+		}
+
+		if !feed.HasBefore || feed.NextBefore == "" {
+			break
+		}
+
+		query.Set("before", feed.NextBefore)
+	}
+
+	if len(names) > maxUrls {
+		names = names[:maxUrls]
+	}
+
+	return names, nil
+}
+
+// skipTlog logs the tlog which failed to load. The hidden and deleted tlogs are skipped silently.
+func (s *Sitemap) skipTlog(path string, err error) {
+	if isGone(err) {
+		return
+	}
+
+	s.log.Warn("sitemap",
+		zap.String("tlog", path),
+		zap.Error(err))
+}
+
+func (s *Sitemap) loadEntries(tlogPath string) ([]urlEntry, error) {
+	var urls []urlEntry
+	query := url.Values{"limit": {"100"}}
+
+	for len(urls) < s.tlogMax {
+		var feed models.Feed
+		err := s.load(tlogPath+"/tlog", query, &feed)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range feed.Entries {
+			if entry == nil || entry.Privacy != "all" {
+				continue
+			}
+
+			urls = append(urls, urlEntry{
+				Loc:        s.webUrl + "/entries/" + strconv.FormatInt(entry.ID, 10),
+				ChangeFreq: "monthly",
+				Priority:   "0.5",
+				lastMod:    unixTime(entry.CreatedAt),
+			})
+		}
+
+		if !feed.HasBefore || feed.NextBefore == "" {
+			break
+		}
+
+		query.Set("before", feed.NextBefore)
+	}
+
+	if len(urls) > s.tlogMax {
+		urls = urls[:s.tlogMax]
+	}
+
+	return urls, nil
+}
+
+func (s *Sitemap) load(path string, query url.Values, data interface{}) error {
+	link := s.apiUrl + path
+	if len(query) > 0 {
+		link += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.mi.AppToken())
+	req.Header.Set("User-Agent", "MindwellWeb")
+
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{path: path, code: resp.StatusCode}
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func sortedNames(sets map[string][]urlEntry) []string {
+	names := []string{"pages", "users", "themes"}
+	for i := 1; ; i++ {
+		name := "entries-" + strconv.Itoa(i)
+		if _, ok := sets[name]; !ok {
+			break
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func unixTime(sec float64) time.Time {
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(frac*1e9))
+}
+
+func formatDate(date time.Time) string {
+	return date.UTC().Format(time.RFC3339)
+}
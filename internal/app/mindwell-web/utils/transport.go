@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+func (m *Mindwell) configDuration(key string, def time.Duration, unit time.Duration) time.Duration {
+	value := m.ConfigInt(key)
+	if value <= 0 {
+		return def
+	}
+
+	return time.Duration(value) * unit
+}
+
+// newApiTransport creates the pooled transport to the API and image servers
+// configured in the api section.
+func newApiTransport(m *Mindwell) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   m.configDuration("api.dial_timeout", 5*time.Second, time.Second),
+		KeepAlive: m.configDuration("api.keep_alive", 30*time.Second, time.Second),
+	}
+
+	maxIdle := m.ConfigInt("api.max_idle_conns_per_host")
+	if maxIdle <= 0 {
+		maxIdle = 64
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdle * 2,
+		MaxIdleConnsPerHost:   maxIdle,
+		IdleConnTimeout:       m.configDuration("api.idle_conn_timeout", 90*time.Second, time.Second),
+		TLSHandshakeTimeout:   m.configDuration("api.tls_timeout", 5*time.Second, time.Second),
+		ResponseHeaderTimeout: m.configDuration("api.response_timeout", 30*time.Second, time.Second),
+		ExpectContinueTimeout: time.Second,
+	}
+
+	retries := m.ConfigInt("api.retries")
+	if retries < 0 {
+		retries = 0
+	}
+
+	return &retryTransport{
+		base:    transport,
+		retries: retries,
+		delay:   m.configDuration("api.retry_delay", 50*time.Millisecond, time.Millisecond),
+	}
+}
+
+// retryTransport repeats idempotent requests without a body which failed to reach the server.
+// The requests are repeated only on connection errors.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	delay   time.Duration
+}
+
+func isRetryable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// isConnectionError reports whether the request has not reached the server.
+// The timeouts are not repeated, since the server may be still processing the request.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	// the connection is reset before the request is written
+	return errors.As(err, &opErr) && opErr.Op == "write" && errors.Is(err, syscall.ECONNRESET)
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.base.RoundTrip(req)
+	if err == nil || !isRetryable(req) {
+		return resp, err
+	}
+
+	for attempt := 1; attempt <= rt.retries; attempt++ {
+		// the web client has gone or the deadline is exceeded, so the response is not needed
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+
+		if !isConnectionError(err) {
+			return nil, err
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(rt.delay * time.Duration(attempt)):
+		}
+
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err = rt.base.RoundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+	}
+
+	return nil, err
+}
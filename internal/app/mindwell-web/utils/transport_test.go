@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "net/http: timeout awaiting response headers" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// failingTransport returns the error on every round trip.
+type failingTransport struct {
+	err   error
+	calls int
+}
+
+func (ft *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ft.calls++
+	return nil, ft.err
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		err   error
+		retry bool
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "api"}}, true},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, false},
+		{timeoutError{}, false},
+		{errors.New("unexpected EOF"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isConnectionError(tt.err); got != tt.retry {
+			t.Errorf("isConnectionError(%v) = %v, want %v", tt.err, got, tt.retry)
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		method string
+		err    error
+		calls  int
+	}{
+		{http.MethodGet, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, 3},
+		{http.MethodGet, timeoutError{}, 1},
+		{http.MethodPost, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, 1},
+	}
+
+	for _, tt := range tests {
+		ft := &failingTransport{err: tt.err}
+		rt := &retryTransport{base: ft, retries: 2}
+
+		req, _ := http.NewRequest(tt.method, "http://api/entries/live", nil)
+		if _, err := rt.RoundTrip(req); err != tt.err {
+			t.Errorf("%s %v: got error %v", tt.method, tt.err, err)
+		}
+
+		if ft.calls != tt.calls {
+			t.Errorf("%s %v: got %d calls, want %d", tt.method, tt.err, ft.calls, tt.calls)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package workpool
+
+import (
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+)
+
+type task struct {
+	key string
+	fn  func()
+}
+
+// Pool runs tasks in a fixed number of goroutines.
+// Tasks with the same key are not queued twice while one is pending.
+type Pool struct {
+	tasks   chan task
+	mu      sync.Mutex
+	pending map[string]bool
+	dropped atomic.Uint64
+	log     *zap.Logger
+}
+
+func New(workers, queue int, log *zap.Logger) *Pool {
+	p := &Pool{
+		tasks:   make(chan task, queue),
+		pending: make(map[string]bool),
+		log:     log,
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *Pool) work() {
+	for t := range p.tasks {
+		p.run(t)
+	}
+}
+
+// run executes the task, so a panic in it does not stop the worker
+// and the key is not left pending forever.
+func (p *Pool) run(t task) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.log.Error("workpool task panicked",
+				zap.String("key", t.key),
+				zap.Any("panic", r),
+				zap.Stack("stack"))
+		}
+
+		p.mu.Lock()
+		delete(p.pending, t.key)
+		p.mu.Unlock()
+	}()
+
+	t.fn()
+}
+
+// Submit queues the task unless a task with the same key is pending.
+// It returns false if the queue is full.
+func (p *Pool) Submit(key string, fn func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pending[key] {
+		return true
+	}
+
+	select {
+	case p.tasks <- task{key: key, fn: fn}:
+		p.pending[key] = true
+		return true
+	default:
+		p.dropped.Add(1)
+		p.log.Warn("workpool queue is full",
+			zap.String("key", key))
+		return false
+	}
+}
+
+// IsPending reports whether the task is queued or running.
+func (p *Pool) IsPending(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pending[key]
+}
+
+// Dropped returns the number of tasks not queued since the queue was full.
+func (p *Pool) Dropped() uint64 {
+	return p.dropped.Load()
+}
@@ -0,0 +1,99 @@
+package workpool
+
+import (
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitIdle(t *testing.T, p *Pool, keys ...string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, key := range keys {
+		for p.IsPending(key) {
+			if time.Now().After(deadline) {
+				t.Fatalf("task %s is still pending", key)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestSubmitCoalescesPendingKeys(t *testing.T) {
+	p := New(4, 100, zap.NewNop())
+
+	release := make(chan struct{})
+	var runs atomic.Int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Submit("key", func() {
+				runs.Add(1)
+				<-release
+			})
+		}()
+	}
+	wg.Wait()
+
+	close(release)
+	waitIdle(t, p, "key")
+
+	if n := runs.Load(); n != 1 {
+		t.Errorf("expected 1 run, got %d", n)
+	}
+}
+
+func TestPanicClearsPendingKey(t *testing.T) {
+	p := New(1, 10, zap.NewNop())
+
+	p.Submit("bad", func() { panic("provider failed") })
+	waitIdle(t, p, "bad")
+
+	done := make(chan struct{})
+	if !p.Submit("bad", func() { close(done) }) {
+		t.Fatal("the task is not queued after a panic")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker has stopped after a panic")
+	}
+}
+
+func TestSubmitCountsDroppedTasks(t *testing.T) {
+	p := New(1, 1, zap.NewNop())
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	p.Submit("running", func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	if !p.Submit("queued", func() {}) {
+		t.Fatal("the queue must have a free slot")
+	}
+
+	if p.Submit("dropped", func() {}) {
+		t.Error("the task is queued to the full queue")
+	}
+
+	if n := p.Dropped(); n != 1 {
+		t.Errorf("expected 1 dropped task, got %d", n)
+	}
+
+	if p.IsPending("dropped") {
+		t.Error("the dropped task is pending")
+	}
+
+	close(release)
+	waitIdle(t, p, "running", "queued")
+}
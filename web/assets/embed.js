@@ -59,6 +59,8 @@ class Embedder {
         this.addEmbeds(document, prov.name())
     }
     addEmbeds(element, type) {
+        this.resolvePending(element)
+
         let query = ".embed"
         if(type)
             query += "[data-type='" + type + "']"
@@ -72,6 +74,52 @@ class Embedder {
 
         setTimeout(() => { this.createEmbeds() }, 0)
     }
+    resolvePending(element) {
+        $(element).find("[data-embed-pending]").each((i, e) => {
+            let mode = e.dataset.embedPending
+            e.removeAttribute("data-embed-pending")
+
+            this.resolve(e, mode, 0)
+        })
+    }
+    resolve(element, mode, attempt) {
+        let isImage = element.tagName === "IMG"
+
+        $.ajax({
+            method: "GET",
+            url: "/embed/resolve",
+            data: {
+                url: element.getAttribute(isImage ? "src" : "href"),
+                type: isImage ? "image" : "link",
+                mode: mode,
+            },
+            dataType: "html",
+            success: (data, status, req) => {
+                if(req.status === 202) {
+                    if(attempt < 5)
+                        setTimeout(() => { this.resolve(element, mode, attempt + 1) }, 1000 * 2 ** attempt)
+                    return
+                }
+
+                let parent = element.parentNode
+                if(!parent)
+                    return
+
+                $(element).replaceWith(data)
+                this.addEmbeds(parent)
+            },
+        })
+    }
+    loadPlaceholder(button) {
+        let placeholder = $(button).closest(".embed-placeholder")
+        let template = placeholder.find("template").get(0)
+        let parent = placeholder.parent().get(0)
+        if(!template || !parent)
+            return
+
+        placeholder.replaceWith(template.content.cloneNode(true))
+        this.addEmbeds(parent)
+    }
     embed(id) {
         let e = this.embeds.get(id)
         if(e)
@@ -129,6 +177,11 @@ class Embedder {
 
 window.embedder = new Embedder()
 
+$(document).on("click", ".embed-placeholder .load-embed", function() {
+    window.embedder.loadPlaceholder(this)
+    return false
+})
+
 class YouTubeEmbed extends Embed {
     constructor(id, onPlay) {
         super(id, onPlay)
@@ -280,3 +280,10 @@ $("#gift-received").change(function(){
 
     return false;
 })
+
+$("#embed-click-to-load").change(function() {
+    if(this.checked)
+        Cookies.set("emb", "click", { expires: 1826, sameSite: "Lax" })
+    else
+        Cookies.remove("emb")
+})